@@ -0,0 +1,12 @@
+// Package auto installs gotcha malloc tracing on import
+// which keeps former gotcha behavior of patching mallocgc on package init.
+// It's supposed to be imported only for side effects
+// `import _ "github.com/1pkg/gotcha/auto"`.
+// Note that installation errors are not fatal, see `gotcha.Status`.
+package auto
+
+import "github.com/1pkg/gotcha"
+
+func init() {
+	_ = gotcha.Install()
+}
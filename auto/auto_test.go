@@ -0,0 +1,14 @@
+package auto
+
+import (
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuto(t *testing.T) {
+	// status has either no error or installation failure reason.
+	require.NotEqual(t, gotcha.ErrNotInstalled, gotcha.Status())
+	require.Equal(t, gotcha.Status() == nil, gotcha.Enabled())
+}
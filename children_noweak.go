@@ -0,0 +1,22 @@
+//go:build !go1.24
+// +build !go1.24
+
+package gotcha
+
+// childref defines strong reference to derived child context
+// as weak references are not supported before go 1.24.
+type childref = *gotchactx
+
+// refer returns reference to provided child context.
+func refer(ctx *gotchactx) childref {
+	return ctx
+}
+
+// deref returns referenced child context.
+func deref(ref childref) *gotchactx {
+	return ref
+}
+
+// abandon is no-op as derived child contexts are held strongly
+// and are only unlinked from parent context children once their trace completes.
+func abandon(pctx, child *gotchactx, n *node) {}
@@ -0,0 +1,29 @@
+//go:build go1.24
+// +build go1.24
+
+package gotcha
+
+import (
+	"runtime"
+	"weak"
+)
+
+// childref defines weak reference to derived child context,
+// so gotcha parent context doesn't keep its derived children alive.
+type childref = weak.Pointer[gotchactx]
+
+// refer returns weak reference to provided child context.
+func refer(ctx *gotchactx) childref {
+	return weak.Make(ctx)
+}
+
+// deref returns referenced child context or nil if it has been collected.
+func deref(ref childref) *gotchactx {
+	return ref.Value()
+}
+
+// abandon attaches runtime cleanup to provided child context
+// that unlinks its node from provided parent context children once it's collected.
+func abandon(pctx, child *gotchactx, n *node) {
+	runtime.AddCleanup(child, pctx.unlink, n)
+}
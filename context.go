@@ -2,18 +2,113 @@ package gotcha
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
+// ErrLimitExceeded defines sentinel error
+// that matches any context limits exceeded error.
+var ErrLimitExceeded = errors.New("context limits have been exceeded")
+
+// ErrSoftLimitExceeded defines sentinel error
+// that matches any context soft limits exceeded warning error.
+var ErrSoftLimitExceeded = errors.New("context soft limits have been exceeded")
+
+// Dimension defines set of context limit dimensions.
+type Dimension uint8
+
+// Context limit dimensions.
+const (
+	DimensionBytes Dimension = 1 << iota
+	DimensionObjects
+	DimensionCalls
+)
+
+func (d Dimension) String() string {
+	dims := make([]string, 0, 3)
+	if d&DimensionBytes != 0 {
+		dims = append(dims, "bytes")
+	}
+	if d&DimensionObjects != 0 {
+		dims = append(dims, "objects")
+	}
+	if d&DimensionCalls != 0 {
+		dims = append(dims, "calls")
+	}
+	return strings.Join(dims, "|")
+}
+
 // ContextLimitsExceeded defines error type for context limit exceeded.
+// It carries the context error was returned from and
+// the origin tracker in the context hierarchy that exceeded its limits
+// with violated dimensions and origin used and limit values.
+// Note that for soft limits warning error limit values are soft limits
+// and for rate limits error used and limit values are sliding window values
+// and non zero window durations are set for the exceeded dimensions.
 type ContextLimitsExceeded struct {
-	Context Context
+	Context                  Context
+	Origin                   Tracker
+	Dimensions               Dimension
+	Bytes, Objects, Calls    int64
+	LBytes, LObjects, LCalls int64
+	WBytes, WObjects, WCalls time.Duration
+	Soft                     bool
 }
 
 func (err ContextLimitsExceeded) Error() string {
-	return fmt.Sprintf("context limits have been exceeded %q", err.Context)
+	details := make([]string, 0, 3)
+	detail := func(dim string, used, limit int64, window time.Duration) {
+		if window > 0 {
+			details = append(details, fmt.Sprintf("%s %d of %d per %s", dim, used, limit, window))
+			return
+		}
+		details = append(details, fmt.Sprintf("%s %d of %d", dim, used, limit))
+	}
+	if err.Dimensions&DimensionBytes != 0 {
+		detail("bytes", err.Bytes, err.LBytes, err.WBytes)
+	}
+	if err.Dimensions&DimensionObjects != 0 {
+		detail("objects", err.Objects, err.LObjects, err.WObjects)
+	}
+	if err.Dimensions&DimensionCalls != 0 {
+		detail("calls", err.Calls, err.LCalls, err.WCalls)
+	}
+	sentinel := ErrLimitExceeded
+	if err.Soft {
+		sentinel = ErrSoftLimitExceeded
+	}
+	return fmt.Sprintf("%s on %s %q", sentinel, strings.Join(details, ", "), err.Origin)
+}
+
+// Is matches context limits exceeded error with `ErrLimitExceeded`
+// and context soft limits exceeded error with `ErrSoftLimitExceeded`.
+func (err ContextLimitsExceeded) Is(target error) bool {
+	if err.Soft {
+		return target == ErrSoftLimitExceeded
+	}
+	return target == ErrLimitExceeded
+}
+
+// ContextAborted defines error and panic value type
+// that is used to abort traced goroutine at the allocation
+// that exceeded context limits in hard stop mode.
+type ContextAborted struct {
+	Context Context
+}
+
+func (err *ContextAborted) Error() string {
+	return fmt.Sprintf("context has been aborted: %v", err.Context.Err())
+}
+
+// Unwrap returns underlying context error.
+func (err *ContextAborted) Unwrap() error {
+	return err.Context.Err()
 }
 
 // Tracker defines memory limit tracker type
@@ -30,20 +125,109 @@ type Tracker interface {
 
 // Context defines gotcha context type
 // which is union between `context.Context` and `Tracker`
-// that additionally could be stringified.
+// that additionally could be stringified, could report allocation
+// call sites, types, size histogram, in use estimation
+// and consistent snapshots, could track soft limits
+// could be named, labeled and queried as context tree
+// and could export pprof allocation profile.
 type Context interface {
 	context.Context
 	String() string
+	CallSites(n int) []CallSite
+	Types(n int) []TypeAlloc
+	Histogram() Histogram
+	SoftLimits() (sbytes, sobjects, scalls int64)
+	SoftExceeded() bool
+	InUse() (bytes, objects int64)
+	Snapshot() Snapshot
+	Name() string
+	Labels() map[string]string
+	Path() string
+	Children() []Context
+	Tree() string
+	Profile(w io.Writer) error
 	Tracker
 }
 
+// signal defines lazily created gotcha context done channel
+// that could be safely closed exactly once.
+type signal struct {
+	ch     chan struct{}
+	closed int32
+}
+
+func (s *signal) close() {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		close(s.ch)
+	}
+}
+
+// glock defines goroutine aware mutex that skips locking
+// for goroutine that already owns the lock, which happens
+// when malloc tracing reenters context from locked section.
+// Note that glock has to be the first field of the structure that embeds it
+// to keep the owner aligned on 32-bit platforms.
+type glock struct {
+	owner int64
+	mu    sync.Mutex
+}
+
+// lock locks mutex for goroutine with provided id
+// and returns false if goroutine already owns the lock.
+func (l *glock) lock(id int64) bool {
+	if atomic.LoadInt64(&l.owner) == id {
+		return false
+	}
+	l.mu.Lock()
+	atomic.StoreInt64(&l.owner, id)
+	return true
+}
+
+func (l *glock) unlock() {
+	atomic.StoreInt64(&l.owner, 0)
+	l.mu.Unlock()
+}
+
 // gotchactx is gotcha context implementation
 // that carries underlying parent `context.Context`.
+// Note that gotcha context keeps lock free list of its derived children
+// to propagate cancellation to them without any allocations,
+// on go 1.24+ children are held weakly, see `childref`.
 type gotchactx struct {
-	parent                   context.Context
-	ptrack                   Tracker
+	// atomically accessed 64-bit fields go first to keep them aligned on 32-bit platforms.
 	bytes, objects, calls    int64
 	lbytes, lobjects, lcalls int64
+	sbytes, sobjects, scalls int64
+	spercent                 int64
+	fbytes, fobjects, fseq   int64
+	seq                      seqlock
+	name                     string
+	labels                   map[string]string
+	parent                   context.Context
+	pctx                     *gotchactx
+	ptrack                   Tracker
+	rtbytes, rtobjects       *rate
+	rtcalls                  *rate
+	mu                       sync.Mutex
+	done                     atomic.Value
+	cause                    atomic.Value
+	canceled                 int32
+	notified                 int32
+	warned                   int32
+	onexceeded               []func(Context, error)
+	ontraced                 []func(Context, error)
+	onsoftexceeded           []func(Context, error)
+	policy                   func(Context, error)
+	panics                   bool
+	panicked                 int32
+	throttle                 time.Duration
+	abort                    *ContextAborted
+	children                 unsafe.Pointer
+	link                     *node
+	sites                    *callsites
+	inuse                    bool
+	types                    *typeallocs
+	hist                     *histogram
 }
 
 // NewContext creates new gotcha context instance
@@ -52,19 +236,39 @@ type gotchactx struct {
 // - bytes: 64 * MiB
 // - objects: Infinity
 // - calls: Infinity
+// - soft bytes, objects and calls: Infinity
 // Note that if parent context is gotcha context
 // then Add, Remains and Exceeded will also target parent context as well
 // which is useful if nested tracking is required.
+// Note that parent context derived from gotcha context, see `FromContext`,
+// is treated as gotcha parent context as well.
+// Note that on go 1.24+ gotcha parent context doesn't keep its derived children
+// alive, so they are removed from its children once they are collected,
+// on older go runtimes they are only removed once their trace completes.
 func NewContext(parent context.Context, opts ...ContextOpt) Context {
 	ctx := &gotchactx{parent: parent}
 	// need to do type assertion here to avoid allocations in malloc.
 	if ptrack, ok := parent.(Tracker); ok {
 		ctx.ptrack = ptrack
 	}
+	pctx, ok := parent.(*gotchactx)
+	if !ok {
+		pctx, _ = parent.Value(ctxkey{}).(*gotchactx)
+	}
+	if pctx != nil {
+		if ctx.ptrack == nil {
+			ctx.ptrack = pctx
+		}
+		ctx.pctx = pctx
+		pctx.adopt(ctx)
+	}
 	opts = append([]ContextOpt{
 		ContextWithLimitBytes(64 * MiB),
 		ContextWithLimitObjects(Infinity),
 		ContextWithLimitCalls(Infinity),
+		ContextWithSoftLimitBytes(Infinity),
+		ContextWithSoftLimitObjects(Infinity),
+		ContextWithSoftLimitCalls(Infinity),
 	}, opts...)
 	for _, opt := range opts {
 		opt(ctx)
@@ -72,73 +276,141 @@ func NewContext(parent context.Context, opts ...ContextOpt) Context {
 	return ctx
 }
 
+// ctxkey defines context value key that gotcha context answers with itself.
+type ctxkey struct{}
+
+// FromContext returns the closest gotcha context
+// from provided context or any context derived from it.
+func FromContext(ctx context.Context) (Context, bool) {
+	gctx, ok := ctx.Value(ctxkey{}).(*gotchactx)
+	return gctx, ok
+}
+
 func (ctx *gotchactx) Deadline() (time.Time, bool) {
 	return ctx.parent.Deadline()
 }
 
 func (ctx *gotchactx) Done() <-chan struct{} {
-	ch := make(chan struct{})
-	// first try direct checks
-	if ctx.Exceeded() {
-		close(ch)
-		return ch
+	defer unguard(guard())
+	ctx.throttled()
+	s, _ := ctx.done.Load().(*signal)
+	if s == nil {
+		// allocate signal before locking as any allocation
+		// could reenter the context through malloc tracing.
+		ns := &signal{ch: make(chan struct{})}
+		ctx.mu.Lock()
+		if s, _ = ctx.done.Load().(*signal); s == nil {
+			s = ns
+			ctx.done.Store(s)
+		}
+		ctx.mu.Unlock()
+		// only the first done call is responsible for parent watching.
+		if s == ns {
+			ctx.watch(s)
+		}
 	}
-	select {
-	case <-ctx.parent.Done():
-		close(ch)
-		return ch
-	default:
+	// first try direct checks that might
+	// have been missed before done creation.
+	if atomic.LoadInt32(&ctx.canceled) == 1 {
+		s.close()
+	} else if ctx.Exceeded() {
+		ctx.exceed()
 	}
-	// if direct checks didn't work then
-	// parent context pooling is the simplest solution here
-	t := time.NewTicker(time.Millisecond)
-	go func() {
-		defer t.Stop()
-		defer close(ch)
-		for {
-			select {
-			case <-ctx.parent.Done():
-				return
-			case <-t.C:
-				if ctx.Exceeded() {
-					return
-				}
-			}
-		}
-	}()
-	return ch
+	return s.ch
 }
 
 func (ctx *gotchactx) Err() error {
+	defer unguard(guard())
+	ctx.throttled()
+	if err := ctx.exceeded(); err != nil {
+		return err
+	}
 	if err := ctx.parent.Err(); err != nil {
 		return err
 	}
-	if ctx.Exceeded() {
-		return ContextLimitsExceeded{Context: ctx}
+	// canceled context keeps limits exceeded error
+	// even if its rate limits are back within sliding window.
+	if cause, _ := ctx.cause.Load().(*ContextLimitsExceeded); cause != nil {
+		return *cause
 	}
 	return nil
 }
 
 func (ctx *gotchactx) Value(key interface{}) interface{} {
+	if _, ok := key.(ctxkey); ok {
+		return ctx
+	}
 	return ctx.parent.Value(key)
 }
 
 func (ctx *gotchactx) String() string {
-	return fmt.Sprintf(
+	str := fmt.Sprintf(
 		"on this context: %d objects has been allocated with total size of %d bytes within %d calls",
 		atomic.LoadInt64(&ctx.objects),
 		atomic.LoadInt64(&ctx.bytes),
 		atomic.LoadInt64(&ctx.calls),
 	)
+	if ctx.hist != nil {
+		hist := ctx.hist.snapshot()
+		str += fmt.Sprintf(
+			" with allocation sizes p50 %d bytes, p90 %d bytes, p99 %d bytes",
+			hist.Percentile(50),
+			hist.Percentile(90),
+			hist.Percentile(99),
+		)
+	}
+	if rate := SampleRate(); rate > 1 {
+		str += fmt.Sprintf(" estimated with 1/%d sampling rate", rate)
+	}
+	return str
 }
 
 func (ctx *gotchactx) Add(bytes, objects, calls int64) {
+	b := guard()
+	ctx.add(bytes, objects, calls)
+	var err error
+	if pctx := ctx.panicking(); pctx != nil {
+		err = pctx.raise()
+	}
+	unguard(b)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// add adds provided usage to the context hierarchy and calls
+// limits exceeded hooks, but it never panics for panic policy contexts,
+// so caller has to check panicking contexts on its own.
+func (ctx *gotchactx) add(bytes, objects, calls int64) {
+	ctx.seq.begin()
 	atomic.AddInt64(&ctx.bytes, bytes*objects)
 	atomic.AddInt64(&ctx.objects, objects)
 	atomic.AddInt64(&ctx.calls, calls)
-	if ctx.ptrack != nil {
+	ctx.seq.end()
+	if ctx.rtbytes != nil || ctx.rtobjects != nil || ctx.rtcalls != nil {
+		now := time.Now()
+		if ctx.rtbytes != nil {
+			ctx.rtbytes.add(bytes*objects, now)
+		}
+		if ctx.rtobjects != nil {
+			ctx.rtobjects.add(objects, now)
+		}
+		if ctx.rtcalls != nil {
+			ctx.rtcalls.add(calls, now)
+		}
+	}
+	if pctx, ok := ctx.ptrack.(*gotchactx); ok {
+		pctx.add(bytes, objects, calls)
+	} else if ctx.ptrack != nil {
 		ctx.ptrack.Add(bytes, objects, calls)
 	}
+	if atomic.LoadInt32(&ctx.notified) == 0 && ctx.Exceeded() {
+		ctx.exceed()
+		ctx.notify()
+	}
+	if atomic.LoadInt32(&ctx.warned) == 0 && len(ctx.onsoftexceeded) > 0 {
+		ctx.warn()
+	}
 }
 
 func (ctx *gotchactx) Used() (bytes, objects, calls int64) {
@@ -147,12 +419,136 @@ func (ctx *gotchactx) Used() (bytes, objects, calls int64) {
 		atomic.LoadInt64(&ctx.calls)
 }
 
+func (ctx *gotchactx) InUse() (bytes, objects int64) {
+	bytes, objects, _ = ctx.Used()
+	if !ctx.inuse {
+		return
+	}
+	bytes -= atomic.LoadInt64(&ctx.fbytes)
+	objects -= atomic.LoadInt64(&ctx.fobjects)
+	if bytes < 0 {
+		bytes = 0
+	}
+	if objects < 0 {
+		objects = 0
+	}
+	return
+}
+
+func (ctx *gotchactx) Snapshot() (s Snapshot) {
+	ctx.seq.read(func() {
+		s.Name = ctx.name
+		s.Time = time.Now()
+		s.Bytes, s.Objects, s.Calls = ctx.Used()
+		s.LBytes, s.LObjects, s.LCalls = ctx.Limits()
+	})
+	return
+}
+
+func (ctx *gotchactx) Name() string {
+	return ctx.name
+}
+
+func (ctx *gotchactx) Labels() map[string]string {
+	labels := make(map[string]string, len(ctx.labels))
+	for k, v := range ctx.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func (ctx *gotchactx) Path() string {
+	names := []string{ctx.display()}
+	for pctx := ctx.pctx; pctx != nil; pctx = pctx.pctx {
+		names = append([]string{pctx.display()}, names...)
+	}
+	return strings.Join(names, " > ")
+}
+
+func (ctx *gotchactx) Children() []Context {
+	var children []Context
+	for n := ctx.head(); n != nil; n = n.following() {
+		if child := deref(n.child); child != nil {
+			children = append(children, child)
+		}
+	}
+	// children list is kept in reverse creation order.
+	for i, j := 0, len(children)-1; i < j; i, j = i+1, j-1 {
+		children[i], children[j] = children[j], children[i]
+	}
+	return children
+}
+
+func (ctx *gotchactx) Tree() string {
+	var b strings.Builder
+	ctx.tree(&b, 0)
+	return b.String()
+}
+
+func (ctx *gotchactx) CallSites(n int) []CallSite {
+	if ctx.sites == nil {
+		return nil
+	}
+	return ctx.sites.top(n)
+}
+
+func (ctx *gotchactx) Profile(w io.Writer) error {
+	if ctx.sites == nil {
+		return ErrCallSitesDisabled
+	}
+	return newProfile().write(w, ctx.sites.top(0), ctx.labels, time.Now())
+}
+
+func (ctx *gotchactx) Types(n int) []TypeAlloc {
+	if ctx.types == nil {
+		return nil
+	}
+	return ctx.types.top(n)
+}
+
+func (ctx *gotchactx) Histogram() Histogram {
+	if ctx.hist == nil {
+		return nil
+	}
+	return ctx.hist.snapshot()
+}
+
 func (ctx *gotchactx) Limits() (lbytes, lobjects, lcalls int64) {
 	return atomic.LoadInt64(&ctx.lbytes),
 		atomic.LoadInt64(&ctx.lobjects),
 		atomic.LoadInt64(&ctx.lcalls)
 }
 
+func (ctx *gotchactx) SoftLimits() (sbytes, sobjects, scalls int64) {
+	sbytes = atomic.LoadInt64(&ctx.sbytes)
+	sobjects = atomic.LoadInt64(&ctx.sobjects)
+	scalls = atomic.LoadInt64(&ctx.scalls)
+	// derive missing soft limits from hard limits percent.
+	if percent := atomic.LoadInt64(&ctx.spercent); percent > 0 {
+		lbytes, lobjects, lcalls := ctx.Limits()
+		if sbytes <= Infinity && lbytes > Infinity {
+			sbytes = lbytes * percent / 100
+		}
+		if sobjects <= Infinity && lobjects > Infinity {
+			sobjects = lobjects * percent / 100
+		}
+		if scalls <= Infinity && lcalls > Infinity {
+			scalls = lcalls * percent / 100
+		}
+	}
+	return
+}
+
+func (ctx *gotchactx) SoftExceeded() bool {
+	if ctx.softexceeded().Dimensions != 0 {
+		return true
+	}
+	if ctx.pctx != nil {
+		return ctx.pctx.SoftExceeded()
+	}
+	return false
+}
+
 func (ctx *gotchactx) Remains() (rbytes, robjects, rcalls int64) {
 	// calculate bytes remains
 	bytes := atomic.LoadInt64(&ctx.bytes)
@@ -196,6 +592,23 @@ func (ctx *gotchactx) Remains() (rbytes, robjects, rcalls int64) {
 	default:
 		rcalls = 0
 	}
+	// limit remains by rate limits sliding window budget
+	now := time.Now()
+	if ctx.rtbytes != nil {
+		if r := ctx.rtbytes.remains(now); rbytes <= Infinity || r < rbytes {
+			rbytes = r
+		}
+	}
+	if ctx.rtobjects != nil {
+		if r := ctx.rtobjects.remains(now); robjects <= Infinity || r < robjects {
+			robjects = r
+		}
+	}
+	if ctx.rtcalls != nil {
+		if r := ctx.rtcalls.remains(now); rcalls <= Infinity || r < rcalls {
+			rcalls = r
+		}
+	}
 	return
 }
 
@@ -209,6 +622,9 @@ func (ctx *gotchactx) Exceeded() bool {
 	if l := atomic.LoadInt64(&ctx.lcalls); l > Infinity && l < atomic.LoadInt64(&ctx.calls) {
 		return true
 	}
+	if ctx.rated().Dimensions != 0 {
+		return true
+	}
 	if ctx.ptrack != nil {
 		return ctx.ptrack.Exceeded()
 	}
@@ -216,7 +632,352 @@ func (ctx *gotchactx) Exceeded() bool {
 }
 
 func (ctx *gotchactx) Reset() {
+	ctx.seq.begin()
 	atomic.StoreInt64(&ctx.bytes, 0)
 	atomic.StoreInt64(&ctx.objects, 0)
 	atomic.StoreInt64(&ctx.calls, 0)
+	ctx.seq.end()
+	atomic.StoreInt64(&ctx.fseq, atomic.LoadInt64(&inuseSeq))
+	atomic.StoreInt64(&ctx.fbytes, 0)
+	atomic.StoreInt64(&ctx.fobjects, 0)
+	if ctx.sites != nil {
+		ctx.sites.reset()
+	}
+	if ctx.types != nil {
+		ctx.types.reset()
+	}
+	if ctx.hist != nil {
+		ctx.hist.reset()
+	}
+	if ctx.rtbytes != nil {
+		ctx.rtbytes.reset()
+	}
+	if ctx.rtobjects != nil {
+		ctx.rtobjects.reset()
+	}
+	if ctx.rtcalls != nil {
+		ctx.rtcalls.reset()
+	}
+	// done signal that hasn't been closed yet is kept, so its waiters
+	// are still notified on the next cancellation and context err
+	// is never nil after it's closed. Closed done signal is dropped
+	// so next done call creates fresh one, while holders of the closed one
+	// observe reset context err as nil.
+	ctx.mu.Lock()
+	if s, _ := ctx.done.Load().(*signal); s != nil && atomic.LoadInt32(&s.closed) == 1 {
+		ctx.done.Store((*signal)(nil))
+	}
+	ctx.cause.Store((*ContextLimitsExceeded)(nil))
+	atomic.StoreInt32(&ctx.canceled, 0)
+	atomic.StoreInt32(&ctx.notified, 0)
+	atomic.StoreInt32(&ctx.warned, 0)
+	atomic.StoreInt32(&ctx.panicked, 0)
+	ctx.mu.Unlock()
+}
+
+// exceeded walks context hierarchy and returns limits exceeded error
+// for the first tracker that exceeded its own limits if any.
+// Note that non gotcha context trackers are considered as hierarchy roots.
+func (ctx *gotchactx) exceeded() error {
+	var t Tracker = ctx
+	for t != nil {
+		err := ContextLimitsExceeded{Context: ctx, Origin: t}
+		err.Bytes, err.Objects, err.Calls = t.Used()
+		err.LBytes, err.LObjects, err.LCalls = t.Limits()
+		if err.LBytes > Infinity && err.LBytes < err.Bytes {
+			err.Dimensions |= DimensionBytes
+		}
+		if err.LObjects > Infinity && err.LObjects < err.Objects {
+			err.Dimensions |= DimensionObjects
+		}
+		if err.LCalls > Infinity && err.LCalls < err.Calls {
+			err.Dimensions |= DimensionCalls
+		}
+		gctx, ok := t.(*gotchactx)
+		if ok && err.Dimensions == 0 {
+			rerr := gctx.rated()
+			rerr.Context = ctx
+			err = rerr
+		}
+		switch {
+		case err.Dimensions != 0:
+			return err
+		case !ok:
+			if t.Exceeded() {
+				return err
+			}
+			return nil
+		}
+		t = gctx.ptrack
+	}
+	return nil
+}
+
+// rated returns rate limits exceeded error for context own rate limits
+// with exceeded dimensions if any.
+func (ctx *gotchactx) rated() (err ContextLimitsExceeded) {
+	if ctx.rtbytes == nil && ctx.rtobjects == nil && ctx.rtcalls == nil {
+		return
+	}
+	err.Context, err.Origin = ctx, ctx
+	now := time.Now()
+	if r := ctx.rtbytes; r != nil {
+		err.Bytes, err.LBytes, err.WBytes = r.sum(now), r.limit, r.window
+		if r.limit < err.Bytes {
+			err.Dimensions |= DimensionBytes
+		}
+	}
+	if r := ctx.rtobjects; r != nil {
+		err.Objects, err.LObjects, err.WObjects = r.sum(now), r.limit, r.window
+		if r.limit < err.Objects {
+			err.Dimensions |= DimensionObjects
+		}
+	}
+	if r := ctx.rtcalls; r != nil {
+		err.Calls, err.LCalls, err.WCalls = r.sum(now), r.limit, r.window
+		if r.limit < err.Calls {
+			err.Dimensions |= DimensionCalls
+		}
+	}
+	return
+}
+
+// softexceeded returns soft limits exceeded warning error
+// for context own soft limits with exceeded dimensions if any.
+// Note that returned error is a plain value, so checking it doesn't allocate.
+func (ctx *gotchactx) softexceeded() (err ContextLimitsExceeded) {
+	err.Context, err.Origin, err.Soft = ctx, ctx, true
+	err.Bytes, err.Objects, err.Calls = ctx.Used()
+	err.LBytes, err.LObjects, err.LCalls = ctx.SoftLimits()
+	if err.LBytes > Infinity && err.LBytes < err.Bytes {
+		err.Dimensions |= DimensionBytes
+	}
+	if err.LObjects > Infinity && err.LObjects < err.Objects {
+		err.Dimensions |= DimensionObjects
+	}
+	if err.LCalls > Infinity && err.LCalls < err.Calls {
+		err.Dimensions |= DimensionCalls
+	}
+	return
+}
+
+// warn calls context soft limits exceeded hooks exactly once
+// in the goroutine that exceeded context soft limits.
+// Note that warned flag is set before soft limits exceeded error
+// is converted to hooks error, as the conversion allocates
+// and could reenter the context through malloc tracing.
+func (ctx *gotchactx) warn() {
+	err := ctx.softexceeded()
+	if err.Dimensions == 0 || !atomic.CompareAndSwapInt32(&ctx.warned, 0, 1) {
+		return
+	}
+	for _, f := range ctx.onsoftexceeded {
+		f(ctx, err)
+	}
+}
+
+// notify calls context limits exceeded hooks and enforcement policy
+// exactly once in the goroutine that exceeded context limits.
+func (ctx *gotchactx) notify() {
+	if !atomic.CompareAndSwapInt32(&ctx.notified, 0, 1) {
+		return
+	}
+	err := ctx.exceeded()
+	if err == nil {
+		return
+	}
+	for _, f := range ctx.onexceeded {
+		f(ctx, err)
+	}
+	if ctx.policy != nil {
+		ctx.policy(ctx, err)
+	}
+}
+
+// panicking returns the first context in the hierarchy with panic policy
+// that exceeded its limits and hasn't panicked yet if any.
+func (ctx *gotchactx) panicking() *gotchactx {
+	for gctx := ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.panics && atomic.LoadInt32(&gctx.panicked) == 0 && gctx.Exceeded() {
+			return gctx
+		}
+	}
+	return nil
+}
+
+// aborts returns whether provided abort belongs to context
+// or any hard stop context in the hierarchy.
+func (ctx *gotchactx) aborts(abort *ContextAborted) bool {
+	for gctx := ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.abort == abort {
+			return true
+		}
+	}
+	return false
+}
+
+// raise returns panic policy limits exceeded error
+// exactly once for the context that exceeded its limits.
+func (ctx *gotchactx) raise() error {
+	if !atomic.CompareAndSwapInt32(&ctx.panicked, 0, 1) {
+		return nil
+	}
+	return ctx.exceeded()
+}
+
+// throttling returns the first context in the hierarchy
+// with throttle policy that exceeded its limits if any.
+func (ctx *gotchactx) throttling() *gotchactx {
+	for gctx := ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.throttle > 0 && gctx.Exceeded() {
+			return gctx
+		}
+	}
+	return nil
+}
+
+// throttled puts caller goroutine to sleep for throttle policy duration
+// if context limits are exceeded, it's called on context done and err checks.
+func (ctx *gotchactx) throttled() {
+	if ctx.throttle > 0 && ctx.Exceeded() {
+		time.Sleep(ctx.throttle)
+	}
+}
+
+// exceed keeps context limits exceeded error as context cancellation cause
+// and cancels the context, so context err is never nil after done is closed.
+func (ctx *gotchactx) exceed() {
+	if atomic.LoadInt32(&ctx.canceled) == 1 {
+		return
+	}
+	if err, ok := ctx.exceeded().(ContextLimitsExceeded); ok {
+		ctx.cause.Store(&err)
+	}
+	ctx.cancel()
+}
+
+// cancel closes context done signal if any
+// and propagates cancellation to all derived children.
+// Note that cancel is called directly from malloc tracing
+// so it should never allocate or lock.
+func (ctx *gotchactx) cancel() {
+	if !atomic.CompareAndSwapInt32(&ctx.canceled, 0, 1) {
+		return
+	}
+	if s, _ := ctx.done.Load().(*signal); s != nil {
+		s.close()
+	}
+	for n := ctx.head(); n != nil; n = n.following() {
+		if child := deref(n.child); child != nil {
+			child.cancel()
+		}
+	}
+}
+
+// watch propagates parent context cancellation to provided context signal.
+// Gotcha parent context propagates cancellation directly,
+// otherwise single goroutine waits either for parent or context done.
+func (ctx *gotchactx) watch(s *signal) {
+	if pctx, ok := ctx.parent.(*gotchactx); ok {
+		// make sure that parent watches its own parent.
+		_ = pctx.Done()
+		return
+	}
+	pdone := ctx.parent.Done()
+	if pdone == nil {
+		return
+	}
+	select {
+	case <-pdone:
+		ctx.cancel()
+		return
+	default:
+	}
+	go func() {
+		select {
+		case <-pdone:
+			ctx.cancel()
+		case <-s.ch:
+		}
+	}()
+}
+
+// display returns context name for display purposes.
+func (ctx *gotchactx) display() string {
+	if ctx.name == "" {
+		return "unnamed"
+	}
+	return ctx.name
+}
+
+// tree writes context subtree with usage
+// of every context node indented by its depth.
+func (ctx *gotchactx) tree(b *strings.Builder, depth int) {
+	bytes, objects, calls := ctx.Used()
+	fmt.Fprintf(
+		b,
+		"%s%s: %d bytes %d objects %d calls\n",
+		strings.Repeat("  ", depth),
+		ctx.display(),
+		bytes,
+		objects,
+		calls,
+	)
+	for _, child := range ctx.Children() {
+		child.(*gotchactx).tree(b, depth+1)
+	}
+}
+
+// node defines single entry of lock free list of context derived children.
+type node struct {
+	child childref
+	next  unsafe.Pointer
+}
+
+// following returns next node in the list of context derived children.
+func (n *node) following() *node {
+	return (*node)(atomic.LoadPointer(&n.next))
+}
+
+// head returns first node in the list of context derived children.
+func (ctx *gotchactx) head() *node {
+	return (*node)(atomic.LoadPointer(&ctx.children))
+}
+
+// adopt atomically prepends provided child context
+// to the list of context derived children.
+func (ctx *gotchactx) adopt(child *gotchactx) {
+	n := &node{child: refer(child)}
+	child.link = n
+	for {
+		head := atomic.LoadPointer(&ctx.children)
+		atomic.StorePointer(&n.next, head)
+		if atomic.CompareAndSwapPointer(&ctx.children, head, unsafe.Pointer(n)) {
+			break
+		}
+	}
+	abandon(ctx, child, n)
+}
+
+// orphan unlinks provided child context from the list of context derived children.
+func (ctx *gotchactx) orphan(child *gotchactx) {
+	ctx.unlink(child.link)
+}
+
+// unlink unlinks provided node from the list of context derived children,
+// removals are serialized by context mutex while adopt and list traversals stay lock free.
+// Note that unlink is no-op for already unlinked nodes.
+func (ctx *gotchactx) unlink(n *node) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	next := atomic.LoadPointer(&n.next)
+	if atomic.CompareAndSwapPointer(&ctx.children, unsafe.Pointer(n), next) {
+		return
+	}
+	for prev := ctx.head(); prev != nil; prev = prev.following() {
+		if atomic.LoadPointer(&prev.next) == unsafe.Pointer(n) {
+			atomic.StorePointer(&prev.next, next)
+			return
+		}
+	}
 }
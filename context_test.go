@@ -1,9 +1,22 @@
 package gotcha
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
@@ -234,8 +247,19 @@ func TestContext(t *testing.T) {
 			require.False(t, true)
 		}
 		require.Error(t, ctx.Err())
-		require.EqualValues(t, ContextLimitsExceeded{Context: ctx}, ctx.Err())
-		require.EqualValues(t, `context limits have been exceeded "on this context: 5 objects has been allocated with total size of 10 bytes within 5 calls"`, ctx.Err().Error())
+		require.EqualValues(t, ContextLimitsExceeded{
+			Context:    ctx,
+			Origin:     ctx,
+			Dimensions: DimensionCalls,
+			Bytes:      10,
+			Objects:    5,
+			Calls:      5,
+			LBytes:     10,
+			LObjects:   5,
+			LCalls:     3,
+		}, ctx.Err())
+		require.True(t, errors.Is(ctx.Err(), ErrLimitExceeded))
+		require.EqualValues(t, `context limits have been exceeded on calls 5 of 3 "on this context: 5 objects has been allocated with total size of 10 bytes within 5 calls"`, ctx.Err().Error())
 		require.Nil(t, ctx.Value("test"))
 		ctx.Reset()
 		_, dok = ctx.Deadline()
@@ -288,3 +312,693 @@ func TestContext(t *testing.T) {
 		require.Equal(t, 100, ctx.Value("test"))
 	})
 }
+
+func TestContextErr(t *testing.T) {
+	pctx := NewContext(
+		context.Background(),
+		ContextWithLimitBytes(10),
+		ContextWithLimitObjects(5),
+		ContextWithLimitCalls(3),
+	)
+	ctx := NewContext(
+		pctx,
+		ContextWithLimitBytes(Infinity),
+		ContextWithLimitObjects(10),
+		ContextWithLimitCalls(Infinity),
+	)
+	require.NoError(t, ctx.Err())
+	ctx.Add(2, 6, 1)
+	err := ctx.Err()
+	require.True(t, errors.Is(err, ErrLimitExceeded))
+	var lerr ContextLimitsExceeded
+	require.True(t, errors.As(err, &lerr))
+	require.Equal(t, ctx, lerr.Context)
+	require.Equal(t, pctx, lerr.Origin)
+	require.Equal(t, DimensionBytes|DimensionObjects, lerr.Dimensions)
+	require.Equal(t, "bytes|objects", lerr.Dimensions.String())
+	require.Equal(t, int64(12), lerr.Bytes)
+	require.Equal(t, int64(6), lerr.Objects)
+	require.Equal(t, int64(10), lerr.LBytes)
+	require.Equal(t, int64(5), lerr.LObjects)
+	require.Contains(t, err.Error(), "context limits have been exceeded on bytes 12 of 10, objects 6 of 5")
+	ctx.Add(1, 5, 1)
+	require.True(t, errors.As(ctx.Err(), &lerr))
+	require.Equal(t, ctx, lerr.Origin)
+	require.Equal(t, DimensionObjects, lerr.Dimensions)
+	require.False(t, errors.Is(context.Canceled, ErrLimitExceeded))
+}
+
+func TestContextPolicies(t *testing.T) {
+	t.Run("context on exceeded hooks", func(t *testing.T) {
+		var calls []string
+		pctx := NewContext(
+			context.Background(),
+			ContextWithLimitCalls(3),
+			ContextWithOnExceeded(func(ctx Context, err error) {
+				require.True(t, errors.Is(err, ErrLimitExceeded))
+				calls = append(calls, "parent")
+			}),
+		)
+		ctx := NewContext(
+			pctx,
+			ContextWithLimitCalls(Infinity),
+			ContextWithOnExceeded(func(ctx Context, err error) {
+				calls = append(calls, "child first")
+			}),
+			ContextWithOnExceeded(func(ctx Context, err error) {
+				calls = append(calls, "child second")
+			}),
+		)
+		ctx.Add(0, 0, 3)
+		require.Empty(t, calls)
+		ctx.Add(0, 0, 1)
+		ctx.Add(0, 0, 1)
+		pctx.Add(0, 0, 1)
+		require.Equal(t, []string{"parent", "child first", "child second"}, calls)
+		ctx.Reset()
+		pctx.Reset()
+		ctx.Add(0, 0, 4)
+		require.Equal(t, []string{"parent", "child first", "child second", "parent", "child first", "child second"}, calls)
+	})
+	t.Run("context log policy", func(t *testing.T) {
+		var buf strings.Builder
+		ctx := NewContext(
+			context.Background(),
+			ContextWithLimitCalls(1),
+			ContextWithPolicyLog(log.New(&buf, "", 0)),
+		)
+		ctx.Add(0, 0, 2)
+		ctx.Add(0, 0, 2)
+		require.Equal(t, "context limits have been exceeded on calls 2 of 1 \"on this context: 0 objects has been allocated with total size of 0 bytes within 2 calls\"\n", buf.String())
+	})
+	t.Run("context panic policy", func(t *testing.T) {
+		ctx := NewContext(
+			context.Background(),
+			ContextWithLimitCalls(1),
+			ContextWithPolicyPanic(),
+		)
+		ctx.Add(0, 0, 1)
+		require.PanicsWithValue(t, ContextLimitsExceeded{
+			Context:    ctx,
+			Origin:     ctx,
+			Dimensions: DimensionCalls,
+			Calls:      2,
+			LBytes:     64 * MiB,
+			LObjects:   Infinity,
+			LCalls:     1,
+		}, func() {
+			ctx.Add(0, 0, 1)
+		})
+		require.NotPanics(t, func() {
+			ctx.Add(0, 0, 1)
+		})
+	})
+	t.Run("context throttle policy", func(t *testing.T) {
+		ctx := NewContext(
+			context.Background(),
+			ContextWithLimitCalls(1),
+			ContextWithPolicyPanic(),
+			ContextWithPolicyThrottle(5*time.Millisecond),
+		)
+		start := time.Now()
+		ctx.Add(0, 0, 1)
+		require.NoError(t, ctx.Err())
+		require.Less(t, int64(time.Since(start)), int64(5*time.Millisecond))
+		for i := 0; i < 3; i++ {
+			ctx.Add(0, 0, 1)
+		}
+		require.Less(t, int64(time.Since(start)), int64(5*time.Millisecond))
+		require.Error(t, ctx.Err())
+		<-ctx.Done()
+		require.Error(t, ctx.Err())
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(15*time.Millisecond))
+	})
+}
+
+func TestContextRateLimits(t *testing.T) {
+	ctx := NewContext(
+		context.Background(),
+		ContextWithLimitCalls(100),
+		ContextWithRateLimitBytes(Infinity, time.Hour),
+		ContextWithRateLimitCalls(5, 100*time.Millisecond),
+	)
+	rb, _, rc := ctx.Remains()
+	require.Equal(t, int64(64*MiB), rb)
+	require.Equal(t, int64(5), rc)
+	ctx = NewContext(
+		context.Background(),
+		ContextWithLimitCalls(100),
+		ContextWithRateLimitCalls(5, 100*time.Millisecond),
+	)
+	ctx.Add(0, 0, 4)
+	_, _, rc = ctx.Remains()
+	require.Equal(t, int64(1), rc)
+	require.False(t, ctx.Exceeded())
+	ctx.Add(0, 0, 2)
+	_, _, rc = ctx.Remains()
+	require.Equal(t, int64(0), rc)
+	require.True(t, ctx.Exceeded())
+	var lerr ContextLimitsExceeded
+	require.True(t, errors.As(ctx.Err(), &lerr))
+	require.Equal(t, DimensionCalls, lerr.Dimensions)
+	require.Equal(t, int64(6), lerr.Calls)
+	require.Equal(t, int64(5), lerr.LCalls)
+	require.Equal(t, 100*time.Millisecond, lerr.WCalls)
+	require.Contains(t, lerr.Error(), "on calls 6 of 5 per 100ms")
+	time.Sleep(150 * time.Millisecond)
+	_, _, rc = ctx.Remains()
+	require.Equal(t, int64(5), rc)
+	require.False(t, ctx.Exceeded())
+	// canceled context keeps its error after sliding window is back within limits.
+	<-ctx.Done()
+	require.True(t, errors.As(ctx.Err(), &lerr))
+	require.Equal(t, DimensionCalls, lerr.Dimensions)
+	require.Equal(t, int64(6), lerr.Calls)
+	_, _, c := ctx.Used()
+	require.Equal(t, int64(6), c)
+	ctx.Add(0, 0, 3)
+	ctx.Reset()
+	_, _, rc = ctx.Remains()
+	require.Equal(t, int64(5), rc)
+	require.NoError(t, ctx.Err())
+}
+
+func TestContextSoftLimits(t *testing.T) {
+	t.Run("context with explicit soft limits", func(t *testing.T) {
+		var errs []error
+		ctx := NewContext(
+			context.Background(),
+			ContextWithLimitCalls(10),
+			ContextWithSoftLimitCalls(5),
+			ContextWithOnSoftExceeded(func(ctx Context, err error) {
+				errs = append(errs, err)
+			}),
+		)
+		sb, so, sc := ctx.SoftLimits()
+		require.Equal(t, int64(Infinity), sb)
+		require.Equal(t, int64(Infinity), so)
+		require.Equal(t, int64(5), sc)
+		ctx.Add(0, 0, 5)
+		require.False(t, ctx.SoftExceeded())
+		require.Empty(t, errs)
+		ctx.Add(0, 0, 1)
+		ctx.Add(0, 0, 1)
+		require.True(t, ctx.SoftExceeded())
+		require.False(t, ctx.Exceeded())
+		require.NoError(t, ctx.Err())
+		require.Len(t, errs, 1)
+		require.True(t, errors.Is(errs[0], ErrSoftLimitExceeded))
+		require.False(t, errors.Is(errs[0], ErrLimitExceeded))
+		require.EqualValues(t, `context soft limits have been exceeded on calls 6 of 5 "on this context: 0 objects has been allocated with total size of 0 bytes within 7 calls"`, errs[0].Error())
+		ctx.Reset()
+		require.False(t, ctx.SoftExceeded())
+		ctx.Add(0, 0, 6)
+		require.Len(t, errs, 2)
+	})
+	t.Run("context with percent soft limits", func(t *testing.T) {
+		pctx := NewContext(
+			context.Background(),
+			ContextWithLimitBytes(100),
+			ContextWithLimitObjects(10),
+			ContextWithSoftLimitObjects(2),
+			ContextWithSoftLimitPercent(80),
+		)
+		ctx := NewContext(pctx, ContextWithLimitBytes(Infinity))
+		sb, so, sc := pctx.SoftLimits()
+		require.Equal(t, int64(80), sb)
+		require.Equal(t, int64(2), so)
+		require.Equal(t, int64(Infinity), sc)
+		ctx.Add(1, 2, 1)
+		require.False(t, ctx.SoftExceeded())
+		ctx.Add(80, 1, 1)
+		require.True(t, pctx.SoftExceeded())
+		require.True(t, ctx.SoftExceeded())
+		require.False(t, ctx.Exceeded())
+	})
+}
+
+func TestContextInUse(t *testing.T) {
+	t.Run("context in use without sampling", func(t *testing.T) {
+		ctx := NewContext(context.Background())
+		ctx.Add(8, 2, 1)
+		b, o := ctx.InUse()
+		require.Equal(t, int64(16), b)
+		require.Equal(t, int64(2), o)
+	})
+	t.Run("context in use sampling rate", func(t *testing.T) {
+		defer SetInUseSampleRate(1)
+		SetInUseSampleRate(0)
+		require.Equal(t, int64(1), InUseSampleRate())
+		SetInUseSampleRate(8)
+		require.Equal(t, int64(8), InUseSampleRate())
+	})
+	t.Run("context in use tracks freed allocations", func(t *testing.T) {
+		installed(t)
+		if !cleanups {
+			t.Skip("in use allocations tracking requires runtime cleanups")
+		}
+		root := NewContext(context.Background(), ContextWithInUseSampling())
+		keep := make([]*[KiB]byte, 0, 25)
+		var child Context
+		_ = Trace(root, func(ctx Context) {
+			child = ctx
+			for i := 0; i < 100; i++ {
+				buf := new([KiB]byte)
+				buf[KiB-1] = byte(i)
+				if i%4 == 0 {
+					keep = append(keep, buf)
+				}
+			}
+		})
+		b, o, _ := root.Used()
+		require.Equal(t, int64(100*KiB), b)
+		require.Equal(t, int64(100), o)
+		// child without in use sampling isn't released.
+		cb, co := child.InUse()
+		require.Equal(t, int64(100*KiB), cb)
+		require.Equal(t, int64(100), co)
+		for i := 0; i < 100; i++ {
+			runtime.GC()
+			if b, _ := root.InUse(); b == 25*KiB {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		b, o = root.InUse()
+		require.Equal(t, int64(25*KiB), b)
+		require.Equal(t, int64(25), o)
+		for i, buf := range keep {
+			require.Equal(t, byte(i*4), buf[KiB-1])
+		}
+		// allocations tracked before reset are never released after it.
+		root.Reset()
+		keep = nil
+		runtime.GC()
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		b, o = root.InUse()
+		require.Equal(t, int64(0), b)
+		require.Equal(t, int64(0), o)
+		require.Equal(t, int64(0), atomic.LoadInt64(&root.(*gotchactx).fbytes))
+	})
+}
+
+func TestContextSnapshot(t *testing.T) {
+	t.Run("context snapshot diffs", func(t *testing.T) {
+		ctx := NewContext(context.Background(), ContextWithLimitObjects(100))
+		ctx.Add(8, 2, 1)
+		s1 := ctx.Snapshot()
+		require.Equal(t, int64(16), s1.Bytes)
+		require.Equal(t, int64(2), s1.Objects)
+		require.Equal(t, int64(1), s1.Calls)
+		require.Equal(t, int64(64*MiB), s1.LBytes)
+		require.Equal(t, int64(100), s1.LObjects)
+		require.Equal(t, int64(Infinity), s1.LCalls)
+		require.Zero(t, s1.Elapsed)
+		time.Sleep(time.Millisecond)
+		ctx.Add(4, 10, 3)
+		s2 := ctx.Snapshot()
+		d := s2.Sub(s1)
+		require.Equal(t, int64(40), d.Bytes)
+		require.Equal(t, int64(10), d.Objects)
+		require.Equal(t, int64(3), d.Calls)
+		require.Equal(t, int64(100), d.LObjects)
+		require.Equal(t, s2.Time, d.Time)
+		require.Equal(t, s2.Time.Sub(s1.Time), d.Elapsed)
+		sum := s1.Add(d)
+		require.Equal(t, s2.Bytes, sum.Bytes)
+		require.Equal(t, s2.Objects, sum.Objects)
+		require.Equal(t, s2.Calls, sum.Calls)
+		require.Equal(t, s2.Time, sum.Time)
+		require.Equal(t, d.Elapsed, sum.Elapsed)
+		b, err := json.Marshal(d)
+		require.NoError(t, err)
+		var jd Snapshot
+		require.NoError(t, json.Unmarshal(b, &jd))
+		require.True(t, d.Time.Equal(jd.Time))
+		jd.Time = d.Time
+		require.Equal(t, d, jd)
+		require.Contains(t, string(b), `"bytes":40,"objects":10,"calls":3,"limit_bytes":67108864,"limit_objects":100,"limit_calls":-1`)
+	})
+	t.Run("context snapshot consistency", func(t *testing.T) {
+		ctx := NewContext(context.Background())
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10000; j++ {
+					ctx.Add(8, 1, 1)
+				}
+			}()
+		}
+		for i := 0; i < 1000; i++ {
+			s := ctx.Snapshot()
+			require.Equal(t, s.Bytes, 8*s.Objects)
+			require.Equal(t, s.Objects, s.Calls)
+		}
+		wg.Wait()
+		s := ctx.Snapshot()
+		require.Equal(t, int64(40000), s.Calls)
+	})
+}
+
+func TestContextDone(t *testing.T) {
+	t.Run("context done is created once", func(t *testing.T) {
+		ngo := runtime.NumGoroutine()
+		ctx := NewContext(context.Background(), ContextWithLimitCalls(3))
+		ch := ctx.Done()
+		for i := 0; i < 100; i++ {
+			require.Equal(t, ch, ctx.Done())
+		}
+		require.Equal(t, ngo, runtime.NumGoroutine())
+		ctx.Add(0, 0, 5)
+		select {
+		case <-ch:
+		default:
+			require.False(t, true)
+		}
+		require.Equal(t, ch, ctx.Done())
+	})
+	t.Run("context done is propagated to children", func(t *testing.T) {
+		pctx := NewContext(context.Background(), ContextWithLimitCalls(3))
+		ctx1 := NewContext(pctx, ContextWithLimitCalls(Infinity))
+		ctx2 := NewContext(pctx, ContextWithLimitCalls(Infinity))
+		ctx3 := NewContext(ctx2, ContextWithLimitCalls(Infinity))
+		ch1, ch3 := ctx1.Done(), ctx3.Done()
+		ctx2.Add(0, 0, 2)
+		select {
+		case <-ch1:
+			require.False(t, true)
+		case <-ch3:
+			require.False(t, true)
+		default:
+		}
+		ctx1.Add(0, 0, 2)
+		<-ch1
+		<-ch3
+		<-pctx.Done()
+		<-ctx2.Done()
+	})
+	t.Run("context done is kept on reset until closed", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ngo := runtime.NumGoroutine()
+		ctx := NewContext(cctx, ContextWithLimitCalls(3))
+		ch := ctx.Done()
+		require.Equal(t, ngo+1, runtime.NumGoroutine())
+		ctx.Reset()
+		// previous done waiters and parent watcher are kept.
+		select {
+		case <-ch:
+			require.False(t, true)
+		default:
+		}
+		require.NoError(t, ctx.Err())
+		require.Equal(t, ch, ctx.Done())
+		require.Equal(t, ngo+1, runtime.NumGoroutine())
+		ctx.Add(0, 0, 4)
+		<-ch
+		require.True(t, errors.Is(ctx.Err(), ErrLimitExceeded))
+		for i := 0; i < 1000 && runtime.NumGoroutine() != ngo; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		require.Equal(t, ngo, runtime.NumGoroutine())
+	})
+	t.Run("context done is renewed on reset once closed", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(context.Background())
+		ctx := NewContext(cctx, ContextWithLimitCalls(3))
+		ch := ctx.Done()
+		ctx.Add(0, 0, 4)
+		<-ch
+		require.True(t, errors.Is(ctx.Err(), ErrLimitExceeded))
+		ctx.Reset()
+		require.NoError(t, ctx.Err())
+		nch := ctx.Done()
+		require.NotEqual(t, ch, nch)
+		select {
+		case <-nch:
+			require.False(t, true)
+		default:
+		}
+		cancel()
+		<-nch
+		require.Equal(t, context.Canceled, ctx.Err())
+	})
+	t.Run("context done is propagated from parent", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(context.Background())
+		pctx := NewContext(cctx)
+		ctx := NewContext(pctx)
+		ch := ctx.Done()
+		cancel()
+		<-ch
+		<-pctx.Done()
+		require.Equal(t, context.Canceled, ctx.Err())
+	})
+}
+
+func TestContextCallSites(t *testing.T) {
+	ctx := NewContext(context.Background(), ContextWithCallSites(1))
+	sites := ctx.(*gotchactx).sites
+	for i := 0; i < 10; i++ {
+		sites.record(1, 8, 2, 1)
+	}
+	func() {
+		sites.record(1, 100, 1, 1)
+	}()
+	top := ctx.CallSites(0)
+	require.Len(t, top, 2)
+	require.Equal(t, int64(160), top[0].Bytes)
+	require.Equal(t, int64(20), top[0].Objects)
+	require.Equal(t, int64(10), top[0].Calls)
+	require.Equal(t, "github.com/1pkg/gotcha.TestContextCallSites", top[0].Function)
+	require.Contains(t, top[0].File, "context_test.go")
+	require.Len(t, top[0].Stack, 1)
+	require.Equal(t, int64(100), top[1].Bytes)
+	require.Equal(t, "github.com/1pkg/gotcha.TestContextCallSites.func1", top[1].Function)
+	top = ctx.CallSites(1)
+	require.Len(t, top, 1)
+	require.Equal(t, int64(160), top[0].Bytes)
+	ctx.Reset()
+	require.Empty(t, ctx.CallSites(0))
+	require.Nil(t, NewContext(context.Background()).CallSites(0))
+}
+
+func TestContextTypes(t *testing.T) {
+	ctx := NewContext(context.Background(), ContextWithTypes())
+	types := ctx.(*gotchactx).types
+	var header, buf interface{} = map[string][]string{}, []byte{}
+	htp := (*eface)(unsafe.Pointer(&header)).tp
+	btp := (*eface)(unsafe.Pointer(&buf)).tp
+	for i := 0; i < 10; i++ {
+		types.record(1, htp, 8, 1, 1)
+	}
+	types.record(1, btp, 24, 100, 1)
+	types.record(1, nil, 1, 10, 1)
+	top := ctx.Types(0)
+	require.Len(t, top, 3)
+	require.Equal(t, "[]uint8", top[0].Name)
+	require.Equal(t, reflect.TypeOf(buf), top[0].Type)
+	require.Equal(t, int64(100), top[0].Objects)
+	require.Equal(t, int64(2400), top[0].Bytes)
+	require.Equal(t, "map[string][]string", top[1].Name)
+	require.Equal(t, int64(80), top[1].Bytes)
+	require.Equal(t, int64(10), top[1].Objects)
+	require.Equal(t, int64(10), top[1].Calls)
+	require.Equal(t, RawType, top[2].Name)
+	require.Nil(t, top[2].Type)
+	require.Len(t, ctx.Types(2), 2)
+	ctx.Reset()
+	require.Empty(t, ctx.Types(0))
+	require.Nil(t, NewContext(context.Background()).Types(0))
+}
+
+func TestContextHistogram(t *testing.T) {
+	ctx := NewContext(context.Background(), ContextWithHistogram())
+	hist := ctx.(*gotchactx).hist
+	for i := 0; i < 80; i++ {
+		hist.record(5, 1)
+	}
+	for i := 0; i < 15; i++ {
+		hist.record(100, 1)
+	}
+	for i := 0; i < 5; i++ {
+		hist.record(MiB, 1)
+	}
+	h := ctx.Histogram()
+	require.Len(t, h, len(sizeClasses)+1)
+	require.Equal(t, HistogramBucket{Size: 8, Count: 80, Bytes: 400}, h[0])
+	require.Equal(t, HistogramBucket{Size: 112, Count: 15, Bytes: 1500}, h[8])
+	require.Equal(t, HistogramBucket{Size: MiB, Count: 5, Bytes: 5 * MiB}, h[len(h)-1])
+	require.Equal(t, int64(8), h.Percentile(50))
+	require.Equal(t, int64(112), h.Percentile(90))
+	require.Equal(t, int64(MiB), h.Percentile(99))
+	require.Equal(t, int64(MiB), h.Percentile(100))
+	require.EqualValues(t, "on this context: 0 objects has been allocated with total size of 0 bytes within 0 calls with allocation sizes p50 8 bytes, p90 112 bytes, p99 1048576 bytes", ctx.String())
+	ctx.Reset()
+	h = ctx.Histogram()
+	require.Equal(t, int64(0), h.Percentile(50))
+	require.Equal(t, int64(Infinity), h[len(h)-1].Size)
+	for i := 0; i < 10; i++ {
+		hist.record(20, 1)
+	}
+	h = ctx.Histogram()
+	require.Equal(t, int64(Infinity), h[len(h)-1].Size)
+	require.Equal(t, int64(24), h.Percentile(0))
+	require.Equal(t, int64(24), h.Percentile(100))
+	require.Nil(t, NewContext(context.Background()).Histogram())
+}
+
+func TestContextTree(t *testing.T) {
+	t.Run("context names and labels", func(t *testing.T) {
+		labels := map[string]string{"route": "/users"}
+		ctx := NewContext(
+			context.Background(),
+			ContextWithName("handler"),
+			ContextWithLabels(labels),
+			ContextWithLabels(map[string]string{"method": "GET"}),
+		)
+		labels["route"] = "/orders"
+		require.Equal(t, "handler", ctx.Name())
+		require.Equal(t, map[string]string{"route": "/users", "method": "GET"}, ctx.Labels())
+		ctx.Labels()["route"] = "/orders"
+		require.Equal(t, "/users", ctx.Labels()["route"])
+		require.Equal(t, "handler", ctx.Snapshot().Name)
+		require.Empty(t, NewContext(context.Background()).Labels())
+	})
+	t.Run("context tree rendering", func(t *testing.T) {
+		root := NewContext(context.Background(), ContextWithName("handler"))
+		decode := NewContext(root, ContextWithName("decode"))
+		query := NewContext(root, ContextWithName("db.query"))
+		encode := NewContext(root, ContextWithName("encode"))
+		anon := NewContext(query)
+		decode.Add(8, 2, 1)
+		anon.Add(16, 1, 1)
+		encode.Add(4, 1, 1)
+		require.Equal(t, []Context{decode, query, encode}, root.Children())
+		require.Equal(t, []Context{anon}, query.Children())
+		require.Empty(t, anon.Children())
+		require.Equal(t, "handler > db.query > unnamed", anon.Path())
+		require.Equal(t, "handler", root.Path())
+		require.Equal(
+			t,
+			"handler: 36 bytes 4 objects 3 calls\n"+
+				"  decode: 16 bytes 2 objects 1 calls\n"+
+				"  db.query: 16 bytes 1 objects 1 calls\n"+
+				"    unnamed: 16 bytes 1 objects 1 calls\n"+
+				"  encode: 4 bytes 1 objects 1 calls\n",
+			root.Tree(),
+		)
+	})
+}
+
+func TestContextTreeDerived(t *testing.T) {
+	root := NewContext(context.Background(), ContextWithName("root"))
+	type key struct{}
+	derived, cancel := context.WithCancel(context.WithValue(root, key{}, "value"))
+	defer cancel()
+	gctx, ok := FromContext(derived)
+	require.True(t, ok)
+	require.Equal(t, root, gctx)
+	_, ok = FromContext(context.Background())
+	require.False(t, ok)
+	child := NewContext(derived, ContextWithName("child"))
+	require.Equal(t, "value", child.Value(key{}))
+	require.Equal(t, []Context{child}, root.Children())
+	require.Equal(t, "root > child", child.Path())
+	child.Add(8, 1, 1)
+	b, o, c := root.Used()
+	require.Equal(t, int64(8), b)
+	require.Equal(t, int64(1), o)
+	require.Equal(t, int64(1), c)
+	gctx, _ = FromContext(child)
+	require.Equal(t, child, gctx)
+}
+
+func TestContextTreeCollected(t *testing.T) {
+	if !cleanups {
+		t.Skip("derived contexts are held strongly before go 1.24")
+	}
+	root := NewContext(context.Background(), ContextWithName("root"))
+	kept := NewContext(root, ContextWithName("kept"))
+	for i := 0; i < 100; i++ {
+		_ = NewContext(root, ContextWithName("dropped"))
+	}
+	require.Len(t, root.Children(), 101)
+	// collected children are unlinked by runtime cleanups.
+	var nodes int
+	for i := 0; i < 1000; i++ {
+		runtime.GC()
+		nodes = 0
+		for n := root.(*gotchactx).head(); n != nil; n = n.following() {
+			nodes++
+		}
+		if nodes == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, 1, nodes)
+	require.Equal(t, []Context{kept}, root.Children())
+	// cancellation is still propagated to kept children.
+	root.(*gotchactx).cancel()
+	<-kept.Done()
+}
+
+func TestContextTreeTraces(t *testing.T) {
+	root := NewContext(context.Background(), ContextWithName("root"))
+	var wg sync.WaitGroup
+	var linked, unlinked int64
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = Trace(root, func(ctx Context) {
+				var cctx Context
+				_ = Trace(ctx, func(ctx Context) {
+					cctx = ctx
+				})
+				children := ctx.Children()
+				if len(children) == 0 {
+					atomic.AddInt64(&unlinked, 1)
+				}
+				for _, child := range root.Children() {
+					if child == ctx && child != cctx {
+						atomic.AddInt64(&linked, 1)
+					}
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(100), linked)
+	require.Equal(t, int64(100), unlinked)
+	require.Empty(t, root.Children())
+}
+
+func TestContextProfile(t *testing.T) {
+	ctx := NewContext(
+		context.Background(),
+		ContextWithCallSites(4),
+		ContextWithLabels(map[string]string{"route": "/users"}),
+	)
+	sites := ctx.(*gotchactx).sites
+	for i := 0; i < 10; i++ {
+		sites.record(1, 8, 2, 1)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, ctx.Profile(&buf))
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	for _, s := range []string{"alloc_objects", "alloc_space", "count", "bytes", "route", "/users", "context_test.go"} {
+		require.Contains(t, string(b), s)
+	}
+	require.Contains(t, string(b), "github.com/1pkg/gotcha.TestContextProfile")
+	require.Equal(t, ErrCallSitesDisabled, NewContext(context.Background()).Profile(&buf))
+	if path := os.Getenv("GOTCHA_TEST_PROFILE"); path != "" {
+		require.NoError(t, ctx.Profile(&buf))
+		require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+	}
+}
@@ -5,5 +5,6 @@ go 1.15
 require (
 	github.com/1pkg/golocal v0.8.0
 	github.com/1pkg/gomonkey v1.0.5
+	github.com/modern-go/gls v0.0.0-20190610040709-84558782a674
 	github.com/stretchr/testify v1.6.1
 )
@@ -0,0 +1,224 @@
+// Package gotchahttp provides net/http middleware
+// that traces every request with own gotcha context allocation budget.
+package gotchahttp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/1pkg/gotcha"
+)
+
+// Usage response headers names.
+const (
+	HeaderBytes   = "X-Gotcha-Bytes"
+	HeaderObjects = "X-Gotcha-Objects"
+	HeaderCalls   = "X-Gotcha-Calls"
+)
+
+// FromContext returns gotcha context of traced request
+// from provided request context or any context derived from it.
+func FromContext(ctx context.Context) (gotcha.Context, bool) {
+	return gotcha.FromContext(ctx)
+}
+
+// HandlerOpt defines gotcha handler option.
+type HandlerOpt func(*handler)
+
+// HandlerWithContext defines gotcha handler option
+// that provides gotcha context options for every request trace.
+func HandlerWithContext(opts ...gotcha.ContextOpt) HandlerOpt {
+	return func(h *handler) {
+		h.opts = append(h.opts, opts...)
+	}
+}
+
+// HandlerWithStatus defines gotcha handler option
+// that sets response status code which is written
+// if request context limits are exceeded before response headers are written.
+func HandlerWithStatus(code int) HandlerOpt {
+	return func(h *handler) {
+		h.status = code
+	}
+}
+
+// HandlerWithUsageHeaders defines gotcha handler option
+// that adds request context bytes, objects and calls usage response headers.
+// Note that usage headers reflect usage at the moment response headers are written.
+func HandlerWithUsageHeaders() HandlerOpt {
+	return func(h *handler) {
+		h.headers = true
+	}
+}
+
+type handler struct {
+	next    http.Handler
+	opts    []gotcha.ContextOpt
+	status  int
+	headers bool
+}
+
+// NewHandler wraps provided http handler with gotcha handler
+// that serves every request inside own gotcha trace
+// and binds trace gotcha context to the request context.
+// By default gotcha handler responds with service unavailable status
+// if request context limits are exceeded before response headers are written.
+// Note that in order to stop request handling right after limits are exceeded
+// either request context has to be respected by handler
+// or `gotcha.ContextWithHardStop` context option has to be provided.
+// Note that malloc tracing has to be installed with `gotcha.Install`,
+// otherwise only manually added request usage is tracked.
+// Note that handler response writer implements `http.Flusher` and `http.Hijacker`
+// only if original response writer implements them.
+func NewHandler(next http.Handler, opts ...HandlerOpt) http.Handler {
+	h := &handler{next: next, status: http.StatusServiceUnavailable}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := &writer{ResponseWriter: w, handler: h}
+	ww := rw.wrap()
+	// trace error is discarded as it's either not installed or degraded malloc tracing error
+	// or hard stop abort error that implies exceeded context limits.
+	_ = gotcha.Trace(r.Context(), func(ctx gotcha.Context) {
+		rw.ctx = ctx
+		h.next.ServeHTTP(ww, r.WithContext(ctx))
+	}, h.opts...)
+	if rw.wrote {
+		return
+	}
+	if errors.Is(rw.ctx.Err(), gotcha.ErrLimitExceeded) {
+		rw.exceed()
+	}
+}
+
+// writer defines gotcha handler response writer
+// that replaces response with handler status
+// if context limits are exceeded before response headers are written.
+type writer struct {
+	http.ResponseWriter
+	handler  *handler
+	ctx      gotcha.Context
+	wrote    bool
+	exceeded bool
+}
+
+func (w *writer) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	if errors.Is(w.ctx.Err(), gotcha.ErrLimitExceeded) {
+		w.exceed()
+		return
+	}
+	w.wrote = true
+	w.usage()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	// discard handler response body after limits exceeded response.
+	if w.exceeded {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns original response writer.
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wrap returns response writer that additionally implements
+// `http.Flusher` and `http.Hijacker` only if original response writer does.
+func (w *writer) wrap() http.ResponseWriter {
+	_, flush := w.ResponseWriter.(http.Flusher)
+	_, hijack := w.ResponseWriter.(http.Hijacker)
+	switch {
+	case flush && hijack:
+		return flushHijackWriter{w}
+	case flush:
+		return flushWriter{w}
+	case hijack:
+		return hijackWriter{w}
+	default:
+		return w
+	}
+}
+
+// flush writes response headers if needed
+// and flushes original response writer.
+func (w *writer) flush() {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// hijack hijacks original response writer connection,
+// so limits exceeded handler status response is never written after it.
+func (w *writer) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		w.wrote = true
+	}
+	return conn, rw, err
+}
+
+type flushWriter struct {
+	*writer
+}
+
+func (w flushWriter) Flush() {
+	w.flush()
+}
+
+type hijackWriter struct {
+	*writer
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+type flushHijackWriter struct {
+	*writer
+}
+
+func (w flushHijackWriter) Flush() {
+	w.flush()
+}
+
+func (w flushHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+// exceed writes limits exceeded handler status response.
+func (w *writer) exceed() {
+	w.wrote, w.exceeded = true, true
+	w.usage()
+	code := w.handler.status
+	http.Error(w.ResponseWriter, http.StatusText(code), code)
+}
+
+// usage sets context usage response headers if needed.
+func (w *writer) usage() {
+	if !w.handler.headers {
+		return
+	}
+	bytes, objects, calls := w.ctx.Used()
+	header := w.Header()
+	header.Set(HeaderBytes, strconv.FormatInt(bytes, 10))
+	header.Set(HeaderObjects, strconv.FormatInt(objects, 10))
+	header.Set(HeaderCalls, strconv.FormatInt(calls, 10))
+}
@@ -0,0 +1,168 @@
+package gotchahttp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	limits := HandlerWithContext(gotcha.ContextWithLimitObjects(100))
+	table := map[string]struct {
+		handler http.HandlerFunc
+		opts    []HandlerOpt
+		code    int
+		body    string
+		headers map[string]string
+		// objects defines expected usage objects header range.
+		objects [2]int64
+	}{
+		"handler within limits should respond normally": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				ctx, ok := FromContext(r.Context())
+				require.True(t, ok)
+				ctx.Add(8, 2, 1)
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte("ok"))
+			},
+			opts: []HandlerOpt{limits, HandlerWithUsageHeaders()},
+			code: http.StatusOK,
+			body: "ok",
+			headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+			objects: [2]int64{2, 100},
+		},
+		"handler exceeding limits before headers should respond with status": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				ctx, _ := FromContext(r.Context())
+				ctx.Add(1, 200, 1)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte("ok"))
+			},
+			opts:    []HandlerOpt{limits, HandlerWithUsageHeaders()},
+			code:    http.StatusServiceUnavailable,
+			body:    "Service Unavailable\n",
+			objects: [2]int64{200, 300},
+		},
+		"handler exceeding limits without response should respond with custom status": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				ctx, _ := FromContext(r.Context())
+				ctx.Add(1, 200, 1)
+				<-r.Context().Done()
+			},
+			opts: []HandlerOpt{limits, HandlerWithStatus(http.StatusInsufficientStorage)},
+			code: http.StatusInsufficientStorage,
+			body: "Insufficient Storage\n",
+			headers: map[string]string{
+				HeaderBytes: "",
+			},
+		},
+		"handler exceeding limits after headers should keep response": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				ctx, _ := FromContext(r.Context())
+				w.WriteHeader(http.StatusAccepted)
+				ctx.Add(1, 200, 1)
+				_, _ = w.Write([]byte("ok"))
+			},
+			opts:    []HandlerOpt{limits, HandlerWithUsageHeaders()},
+			code:    http.StatusAccepted,
+			body:    "ok",
+			objects: [2]int64{0, 100},
+		},
+		"handler nested traces should roll up into request context": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				ctx, cancel := context.WithCancel(r.Context())
+				defer cancel()
+				_ = gotcha.Trace(ctx, func(nctx gotcha.Context) {
+					rctx, ok := FromContext(r.Context())
+					require.True(t, ok)
+					require.Equal(t, []gotcha.Context{nctx}, rctx.Children())
+					nctx.Add(8, 50, 1)
+				}, gotcha.ContextWithName("nested"))
+				_, _ = w.Write([]byte("ok"))
+			},
+			opts:    []HandlerOpt{limits, HandlerWithUsageHeaders()},
+			code:    http.StatusOK,
+			body:    "ok",
+			objects: [2]int64{50, 100},
+		},
+		"handler flushing response should forward flushes": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				f, ok := w.(http.Flusher)
+				require.True(t, ok)
+				f.Flush()
+				ctx, _ := FromContext(r.Context())
+				ctx.Add(1, 200, 1)
+				_, _ = w.Write([]byte("ok"))
+			},
+			opts:    []HandlerOpt{limits, HandlerWithUsageHeaders()},
+			code:    http.StatusOK,
+			body:    "ok",
+			objects: [2]int64{0, 100},
+		},
+		"handler hijacking connection should keep hijacked response": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				h, ok := w.(http.Hijacker)
+				require.True(t, ok)
+				conn, buf, err := h.Hijack()
+				require.NoError(t, err)
+				defer conn.Close()
+				ctx, _ := FromContext(r.Context())
+				ctx.Add(1, 200, 1)
+				_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+				_ = buf.Flush()
+			},
+			opts: []HandlerOpt{limits},
+			code: http.StatusOK,
+			body: "ok",
+		},
+	}
+	for tname, tcase := range table {
+		t.Run(tname, func(t *testing.T) {
+			srv := httptest.NewServer(NewHandler(tcase.handler, tcase.opts...))
+			defer srv.Close()
+			resp, err := http.Get(srv.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tcase.code, resp.StatusCode)
+			require.Equal(t, tcase.body, string(body))
+			for k, v := range tcase.headers {
+				require.Equal(t, v, resp.Header.Get(k))
+			}
+			// traced usage also contains handler and server allocations.
+			if tcase.objects != [2]int64{} {
+				objects, err := strconv.ParseInt(resp.Header.Get(HeaderObjects), 10, 64)
+				require.NoError(t, err)
+				require.GreaterOrEqual(t, objects, tcase.objects[0])
+				require.LessOrEqual(t, objects, tcase.objects[1])
+				require.NotEmpty(t, resp.Header.Get(HeaderBytes))
+				require.NotEmpty(t, resp.Header.Get(HeaderCalls))
+			}
+		})
+	}
+}
+
+func TestHandlerWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(http.Hijacker)
+		require.False(t, ok)
+		f, ok := w.(http.Flusher)
+		require.True(t, ok)
+		f.Flush()
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.True(t, rec.Flushed)
+	require.Equal(t, http.StatusOK, rec.Code)
+	w := &writer{ResponseWriter: struct{ http.ResponseWriter }{rec}}
+	_, ok := w.wrap().(http.Flusher)
+	require.False(t, ok)
+}
@@ -0,0 +1,123 @@
+// Package gotchatest provides testing helpers
+// that assert allocation budgets of traced test functions.
+// Unlike `testing.AllocsPerRun` helpers are safe to use with `t.Parallel`
+// as gotcha tracks allocations per goroutine.
+// Helpers install gotcha malloc tracing on first use
+// and report test error if it can't be installed
+// or skip the test if malloc tracing is degraded, see `gotcha.ErrDegraded`,
+// as degraded tracing would silently under count allocations.
+// Benchmark helpers still run benchmarks on degraded malloc tracing
+// but don't report gotcha metrics then.
+package gotchatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/1pkg/gotcha"
+)
+
+// callSitesDepth defines failure report call sites depth.
+const callSitesDepth = 8
+
+// callSitesTop defines failure report number of top call sites.
+const callSitesTop = 5
+
+// T defines subset of `testing.TB` used by assertions.
+type T interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Skipf(format string, args ...interface{})
+}
+
+// Limits defines allocation budget of bytes, objects and calls.
+// Note that zero limits don't allow any allocation
+// so gotcha.Infinity has to be used explicitly to disable any limit.
+type Limits struct {
+	Bytes, Objects, Calls int64
+}
+
+// AssertMaxAlloc traces provided function and reports test error
+// if provided allocation limits were exceeded by the function.
+// Failure report contains context usage and top allocation call sites if any.
+// Assert returns true if function fits into provided limits.
+func AssertMaxAlloc(t T, limits Limits, fn func()) bool {
+	t.Helper()
+	if !install(t) {
+		return false
+	}
+	return assert(t, limits, func(gotcha.Context) {
+		fn()
+	})
+}
+
+// AssertNoAlloc traces provided function and reports test error
+// if the function allocates anything on the heap.
+// Assert returns true if function doesn't allocate.
+func AssertNoAlloc(t T, fn func()) bool {
+	t.Helper()
+	return AssertMaxAlloc(t, Limits{}, fn)
+}
+
+// assert traces provided tracer within provided limits
+// and reports test error if limits were exceeded.
+func assert(t T, limits Limits, tracer gotcha.Tracer) bool {
+	t.Helper()
+	var gctx gotcha.Context
+	_ = gotcha.Trace(context.Background(), func(ctx gotcha.Context) {
+		gctx = ctx
+		tracer(ctx)
+	},
+		gotcha.ContextWithLimitBytes(limits.Bytes),
+		gotcha.ContextWithLimitObjects(limits.Objects),
+		gotcha.ContextWithLimitCalls(limits.Calls),
+		gotcha.ContextWithCallSites(callSitesDepth),
+	)
+	if !gctx.Exceeded() {
+		return true
+	}
+	t.Errorf("%s", report(gctx))
+	return false
+}
+
+// install installs gotcha malloc tracing and reports test error
+// if it can't be installed or skips the test if it's degraded.
+func install(t T) bool {
+	t.Helper()
+	switch err := gotcha.Install(); {
+	case errors.Is(err, gotcha.ErrDegraded):
+		t.Skipf("gotcha malloc tracing can't assert allocations, build tests with GOEXPERIMENT=nosizespecializedmalloc: %v", err)
+		return false
+	case err != nil:
+		t.Errorf("gotcha malloc tracing can't be installed: %v", err)
+		return false
+	}
+	return true
+}
+
+// report returns context allocation budget failure report.
+// Note that context limits exceeded error already contains context string.
+func report(ctx gotcha.Context) string {
+	var b strings.Builder
+	b.WriteString(ctx.Err().Error())
+	sites := ctx.CallSites(callSitesTop)
+	if len(sites) == 0 {
+		return b.String()
+	}
+	b.WriteString("\ntop allocation call sites:")
+	for _, site := range sites {
+		fmt.Fprintf(
+			&b,
+			"\n\t%s %s:%d %d bytes %d objects %d calls",
+			site.Function,
+			site.File,
+			site.Line,
+			site.Bytes,
+			site.Objects,
+			site.Calls,
+		)
+	}
+	return b.String()
+}
@@ -0,0 +1,135 @@
+package gotchatest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeT struct {
+	errors []string
+	skips  []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) Skipf(format string, args ...interface{}) {
+	t.skips = append(t.skips, fmt.Sprintf(format, args...))
+}
+
+// installed skips test if gotcha malloc tracing can't be installed.
+// Note that degraded malloc tracing still traces manually added usage.
+func installed(t *testing.T) {
+	if err := gotcha.Install(); err != nil && !errors.Is(err, gotcha.ErrDegraded) {
+		t.Skip(err)
+	}
+}
+
+// enabled skips test if gotcha malloc tracing can't trace all allocations.
+func enabled(t *testing.T) {
+	if err := gotcha.Install(); err != nil {
+		t.Skip(err)
+	}
+}
+
+// sink defines escaping allocations destination.
+var sink []byte
+
+// small defines small object that could bypass mallocgc.
+type small struct {
+	a, b int64
+}
+
+// ssink defines escaping small objects destination.
+var ssink *small
+
+func TestAssert(t *testing.T) {
+	installed(t)
+	t.Run("assert within limits should pass", func(t *testing.T) {
+		t.Parallel()
+		ft := &fakeT{}
+		require.True(t, assert(ft, Limits{Bytes: 100, Objects: gotcha.Infinity, Calls: 2}, func(ctx gotcha.Context) {
+			ctx.Add(10, 10, 2)
+		}))
+		require.Empty(t, ft.errors)
+	})
+	t.Run("assert exceeding limits should fail with report", func(t *testing.T) {
+		t.Parallel()
+		ft := &fakeT{}
+		require.False(t, assert(ft, Limits{Bytes: 100, Objects: gotcha.Infinity, Calls: gotcha.Infinity}, func(ctx gotcha.Context) {
+			ctx.Add(101, 1, 1)
+		}))
+		require.Len(t, ft.errors, 1)
+		require.Equal(
+			t,
+			"context limits have been exceeded on bytes 101 of 100 "+
+				"\"on this context: 1 objects has been allocated with total size of 101 bytes within 1 calls\"",
+			ft.errors[0],
+		)
+	})
+	t.Run("assert no alloc should fail on any allocation", func(t *testing.T) {
+		t.Parallel()
+		ft := &fakeT{}
+		require.False(t, assert(ft, Limits{}, func(ctx gotcha.Context) {
+			ctx.Add(1, 1, 1)
+		}))
+		require.Len(t, ft.errors, 1)
+	})
+}
+
+func TestAssertAlloc(t *testing.T) {
+	if err := gotcha.Install(); errors.Is(err, gotcha.ErrDegraded) {
+		t.Run("assert should skip on degraded malloc tracing", func(t *testing.T) {
+			ft := &fakeT{}
+			require.False(t, AssertNoAlloc(ft, func() {
+				ssink = &small{1, 2}
+			}))
+			require.Empty(t, ft.errors)
+			require.Len(t, ft.skips, 1)
+			require.Contains(t, ft.skips[0], "GOEXPERIMENT=nosizespecializedmalloc")
+			require.Contains(t, ft.skips[0], gotcha.ErrDegraded.Error())
+		})
+	}
+	enabled(t)
+	t.Run("assert no alloc should pass on no allocations", func(t *testing.T) {
+		t.Parallel()
+		ft := &fakeT{}
+		require.True(t, AssertNoAlloc(ft, func() {}))
+		require.True(t, AssertMaxAlloc(ft, Limits{}, func() {}))
+		require.Empty(t, ft.errors)
+	})
+	t.Run("assert no alloc should fail on small object allocation", func(t *testing.T) {
+		t.Parallel()
+		ft := &fakeT{}
+		require.False(t, AssertNoAlloc(ft, func() {
+			ssink = &small{1, 2}
+		}))
+		require.Len(t, ft.errors, 1)
+		require.Contains(t, ft.errors[0], "context limits have been exceeded")
+	})
+	t.Run("assert max alloc should fit exact budget", func(t *testing.T) {
+		t.Parallel()
+		ft := &fakeT{}
+		alloc := func() {
+			for i := 0; i < 10; i++ {
+				sink = make([]byte, 4096)
+			}
+		}
+		require.True(t, AssertMaxAlloc(ft, Limits{Bytes: 40960, Objects: 40960, Calls: 10}, alloc))
+		require.Empty(t, ft.errors)
+		require.False(t, AssertMaxAlloc(ft, Limits{Bytes: 40959, Objects: 40960, Calls: 10}, alloc))
+		require.False(t, AssertMaxAlloc(ft, Limits{Bytes: 40960, Objects: 40960, Calls: 9}, alloc))
+		require.Len(t, ft.errors, 2)
+		require.Contains(t, ft.errors[0], "context limits have been exceeded on bytes")
+		require.Contains(t, ft.errors[0], "top allocation call sites:")
+		require.Contains(t, ft.errors[0], "assert_test.go")
+		require.Contains(t, ft.errors[1], "context limits have been exceeded on calls")
+	})
+}
@@ -0,0 +1,116 @@
+package gotchatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+)
+
+// Benchmark reported gotcha metrics units.
+const (
+	UnitBytes   = "gotcha-B/op"
+	UnitObjects = "gotcha-objects/op"
+	UnitCalls   = "gotcha-calls/op"
+)
+
+// Benchmark runs provided benchmark body b.N times inside single trace
+// and reports traced bytes, objects and calls per operation.
+// Unlike builtin benchmark allocations metrics gotcha metrics
+// are not polluted by allocations of background goroutines.
+// Note that if malloc tracing is degraded benchmark body is still run,
+// but gotcha metrics are not reported as they would under count allocations.
+func Benchmark(b *testing.B, fn func()) {
+	b.Helper()
+	report, ok := benchmarking(b)
+	if !ok {
+		return
+	}
+	benchmark(b, func(gotcha.Context) {
+		fn()
+	}, report)
+}
+
+// BenchmarkParallel runs provided benchmark body in parallel with `b.RunParallel`
+// where each worker goroutine is traced by its own gotcha context
+// and reports total traced bytes, objects and calls per operation.
+// Note that if malloc tracing is degraded benchmark body is still run,
+// but gotcha metrics are not reported as they would under count allocations.
+func BenchmarkParallel(b *testing.B, fn func()) {
+	b.Helper()
+	report, ok := benchmarking(b)
+	if !ok {
+		return
+	}
+	benchmarkParallel(b, func(gotcha.Context) {
+		fn()
+	}, report)
+}
+
+// benchmarking installs gotcha malloc tracing and reports benchmark error
+// if it can't be installed, unlike install it doesn't skip the benchmark
+// if malloc tracing is degraded, but logs that gotcha metrics are unavailable.
+// Benchmarking returns whether gotcha metrics should be reported
+// and whether benchmark should be run.
+func benchmarking(b *testing.B) (report, ok bool) {
+	b.Helper()
+	switch err := gotcha.Install(); {
+	case errors.Is(err, gotcha.ErrDegraded):
+		b.Logf("gotcha metrics are unavailable, build benchmarks with GOEXPERIMENT=nosizespecializedmalloc: %v", err)
+		return false, true
+	case err != nil:
+		b.Errorf("gotcha malloc tracing can't be installed: %v", err)
+		return false, false
+	}
+	return true, true
+}
+
+// benchmark runs provided tracer b.N times inside single trace
+// and reports gotcha metrics if requested.
+func benchmark(b *testing.B, tracer gotcha.Tracer, report bool) {
+	b.Helper()
+	ctx := gotcha.NewContext(context.Background(), gotcha.ContextWithLimitBytes(gotcha.Infinity))
+	b.ResetTimer()
+	_ = gotcha.Trace(ctx, func(ctx gotcha.Context) {
+		for i := 0; i < b.N; i++ {
+			tracer(ctx)
+		}
+	})
+	b.StopTimer()
+	if report {
+		metrics(b, ctx)
+	}
+}
+
+// benchmarkParallel runs provided tracer in parallel b.N times
+// inside own worker goroutine traces derived from single context
+// and reports gotcha metrics if requested.
+func benchmarkParallel(b *testing.B, tracer gotcha.Tracer, report bool) {
+	b.Helper()
+	ctx := gotcha.NewContext(context.Background(), gotcha.ContextWithLimitBytes(gotcha.Infinity))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		_ = gotcha.Trace(ctx, func(ctx gotcha.Context) {
+			for pb.Next() {
+				tracer(ctx)
+			}
+		}, gotcha.ContextWithLimitBytes(gotcha.Infinity))
+	})
+	b.StopTimer()
+	if report {
+		metrics(b, ctx)
+	}
+}
+
+// metrics reports provided context usage per benchmark operation.
+func metrics(b *testing.B, ctx gotcha.Context) {
+	if b.N == 0 {
+		return
+	}
+	bytes, objects, calls := ctx.Used()
+	n := float64(b.N)
+	b.ReportMetric(float64(bytes)/n, UnitBytes)
+	b.ReportMetric(float64(objects)/n, UnitObjects)
+	b.ReportMetric(float64(calls)/n, UnitCalls)
+}
@@ -0,0 +1,74 @@
+package gotchatest
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/stretchr/testify/require"
+)
+
+// goldenBenchmark defines benchmark metrics budgets golden file.
+const goldenBenchmark = "testdata/benchmark.json"
+
+func TestBenchmark(t *testing.T) {
+	installed(t)
+	alloc := func(ctx gotcha.Context) {
+		ctx.Add(8, 2, 1)
+	}
+	// metrics compares benchmark gotcha metrics rounded to whole units
+	// with golden budget, incidental runtime allocations traced along
+	// benchmark body are covered by golden budget tolerance.
+	metrics := func(t *testing.T, name string, res testing.BenchmarkResult) {
+		require.Greater(t, res.N, 0)
+		require.GreaterOrEqual(t, res.Extra[UnitBytes], float64(16))
+		require.GreaterOrEqual(t, res.Extra[UnitObjects], float64(2))
+		require.GreaterOrEqual(t, res.Extra[UnitCalls], float64(1))
+		require.True(t, compare(
+			t,
+			goldenBenchmark,
+			name,
+			*update,
+			int64(math.Round(res.Extra[UnitBytes])),
+			int64(math.Round(res.Extra[UnitObjects])),
+			int64(math.Round(res.Extra[UnitCalls])),
+		))
+	}
+	t.Run("benchmark reports traced metrics", func(t *testing.T) {
+		metrics(t, "benchmark", testing.Benchmark(func(b *testing.B) {
+			benchmark(b, alloc, true)
+		}))
+	})
+	t.Run("parallel benchmark reports traced metrics", func(t *testing.T) {
+		metrics(t, "parallel benchmark", testing.Benchmark(func(b *testing.B) {
+			benchmarkParallel(b, alloc, true)
+		}))
+	})
+	t.Run("benchmark runs without metrics on degraded malloc tracing", func(t *testing.T) {
+		var n int
+		res := testing.Benchmark(func(b *testing.B) {
+			benchmark(b, func(gotcha.Context) {
+				n++
+			}, false)
+		})
+		require.Greater(t, res.N, 0)
+		require.GreaterOrEqual(t, n, res.N)
+		require.NotContains(t, res.Extra, UnitBytes)
+		require.NotContains(t, res.Extra, UnitObjects)
+		require.NotContains(t, res.Extra, UnitCalls)
+	})
+	t.Run("parallel benchmark runs without metrics on degraded malloc tracing", func(t *testing.T) {
+		var n int64
+		res := testing.Benchmark(func(b *testing.B) {
+			benchmarkParallel(b, func(gotcha.Context) {
+				atomic.AddInt64(&n, 1)
+			}, false)
+		})
+		require.Greater(t, res.N, 0)
+		require.GreaterOrEqual(t, n, int64(res.N))
+		require.NotContains(t, res.Extra, UnitBytes)
+		require.NotContains(t, res.Extra, UnitObjects)
+		require.NotContains(t, res.Extra, UnitCalls)
+	})
+}
@@ -0,0 +1,116 @@
+package gotchatest
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/1pkg/gotcha"
+)
+
+// DefaultTolerance defines relative tolerance of newly recorded golden budgets.
+const DefaultTolerance = 0.1
+
+var update = flag.Bool("gotcha.update", false, "update gotcha golden allocation budgets files")
+
+// goldenLock serializes golden files access between parallel tests.
+var goldenLock sync.Mutex
+
+// Budget defines golden scenario allocation budget
+// with relative tolerance above which usage is considered regression.
+type Budget struct {
+	Bytes     int64   `json:"bytes"`
+	Objects   int64   `json:"objects"`
+	Calls     int64   `json:"calls"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+// AssertGolden traces provided named scenario function and compares its usage
+// with scenario budget from provided golden json file reporting test error
+// if any of bytes, objects or calls usage exceeds budget tolerance.
+// When tests are run with `-gotcha.update` flag golden file scenario budget
+// is rewritten with traced usage keeping existing scenario tolerance.
+// Assert returns true if scenario usage fits into its golden budget.
+func AssertGolden(t T, path, name string, fn func()) bool {
+	t.Helper()
+	if !install(t) {
+		return false
+	}
+	return golden(t, path, name, *update, func(gotcha.Context) {
+		fn()
+	})
+}
+
+// golden traces provided tracer and compares
+// or updates its usage in provided golden file.
+func golden(t T, path, name string, update bool, tracer gotcha.Tracer) bool {
+	t.Helper()
+	var gctx gotcha.Context
+	_ = gotcha.Trace(context.Background(), func(ctx gotcha.Context) {
+		gctx = ctx
+		tracer(ctx)
+	}, gotcha.ContextWithLimitBytes(gotcha.Infinity))
+	bytes, objects, calls := gctx.Used()
+	return compare(t, path, name, update, bytes, objects, calls)
+}
+
+// compare compares or updates provided scenario usage in provided golden file.
+func compare(t T, path, name string, update bool, bytes, objects, calls int64) bool {
+	t.Helper()
+	goldenLock.Lock()
+	defer goldenLock.Unlock()
+	budgets := make(map[string]Budget)
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &budgets); err != nil {
+			t.Errorf("golden file %q can't be parsed: %v", path, err)
+			return false
+		}
+	case !os.IsNotExist(err) || !update:
+		t.Errorf("golden file %q can't be read: %v", path, err)
+		return false
+	}
+	budget, ok := budgets[name]
+	if update {
+		if !ok {
+			budget.Tolerance = DefaultTolerance
+		}
+		budget.Bytes, budget.Objects, budget.Calls = bytes, objects, calls
+		budgets[name] = budget
+		b, err := json.MarshalIndent(budgets, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(path, append(b, '\n'), 0644)
+		}
+		if err != nil {
+			t.Errorf("golden file %q can't be written: %v", path, err)
+			return false
+		}
+		return true
+	}
+	if !ok {
+		t.Errorf("golden file %q has no scenario %q budget, run tests with -gotcha.update flag", path, name)
+		return false
+	}
+	pass := true
+	check := func(dim string, used, golden int64) {
+		if limit := float64(golden) * (1 + budget.Tolerance); float64(used) > limit {
+			t.Errorf(
+				"golden scenario %q %s regression: %d used, %d golden with %g tolerance",
+				name,
+				dim,
+				used,
+				golden,
+				budget.Tolerance,
+			)
+			pass = false
+		}
+	}
+	check("bytes", bytes, budget.Bytes)
+	check("objects", objects, budget.Objects)
+	check("calls", calls, budget.Calls)
+	return pass
+}
@@ -0,0 +1,71 @@
+package gotchatest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGolden(t *testing.T) {
+	installed(t)
+	dir, err := ioutil.TempDir("", "gotcha")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "budgets.json")
+	alloc := func(bytes, objects, calls int64) gotcha.Tracer {
+		return func(ctx gotcha.Context) {
+			ctx.Add(bytes, objects, calls)
+		}
+	}
+	ft := &fakeT{}
+	require.False(t, golden(ft, path, "decode", false, alloc(1, 1, 1)))
+	require.Len(t, ft.errors, 1)
+	require.Contains(t, ft.errors[0], "can't be read")
+	require.True(t, golden(ft, path, "decode", true, alloc(10, 10, 1)))
+	require.True(t, golden(ft, path, "encode", true, alloc(4, 5, 5)))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		`{
+  "decode": {
+    "bytes": 100,
+    "objects": 10,
+    "calls": 1,
+    "tolerance": 0.1
+  },
+  "encode": {
+    "bytes": 20,
+    "objects": 5,
+    "calls": 5,
+    "tolerance": 0.1
+  }
+}
+`,
+		string(b),
+	)
+	ft = &fakeT{}
+	require.True(t, golden(ft, path, "decode", false, alloc(11, 10, 1)))
+	require.True(t, golden(ft, path, "encode", false, alloc(1, 1, 1)))
+	require.Empty(t, ft.errors)
+	require.False(t, golden(ft, path, "decode", false, alloc(12, 10, 2)))
+	require.Equal(t, []string{
+		`golden scenario "decode" bytes regression: 120 used, 100 golden with 0.1 tolerance`,
+		`golden scenario "decode" calls regression: 2 used, 1 golden with 0.1 tolerance`,
+	}, ft.errors)
+	ft = &fakeT{}
+	require.False(t, golden(ft, path, "query", false, alloc(1, 1, 1)))
+	require.Equal(t, []string{
+		`golden file "` + path + `" has no scenario "query" budget, run tests with -gotcha.update flag`,
+	}, ft.errors)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"decode":{"bytes":1,"objects":1,"calls":1,"tolerance":2}}`), 0644))
+	require.True(t, golden(ft, path, "decode", true, alloc(50, 2, 1)))
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"tolerance": 2`)
+	require.Contains(t, string(b), `"bytes": 100`)
+}
@@ -0,0 +1,106 @@
+package gotcha
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// sizeClasses from `runtime/sizeclasses.go`
+var sizeClasses = [...]int64{
+	8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224, 240, 256,
+	288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768, 896, 1024, 1152, 1280,
+	1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200, 3456, 4096, 4864, 5376, 6144, 6528,
+	6784, 6912, 8192, 9472, 9728, 10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072,
+	20480, 21760, 24576, 27264, 28672, 32768,
+}
+
+// HistogramBucket defines single allocation size histogram bucket
+// that holds allocations with sizes up to bucket size.
+// Note that large objects bucket size is max traced allocation size
+// or Infinity if no large objects were traced.
+type HistogramBucket struct {
+	Size, Count, Bytes int64
+}
+
+// Histogram defines allocation size histogram buckets
+// keyed by go runtime size classes with extra large objects bucket.
+type Histogram []HistogramBucket
+
+// Percentile returns size of bucket that holds
+// provided percentile in range [0, 100] of allocations count.
+func (h Histogram) Percentile(p float64) int64 {
+	var total int64
+	for _, b := range h {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(p / 100 * float64(total))
+	var count, last int64
+	for _, b := range h {
+		if b.Count == 0 {
+			continue
+		}
+		count += b.Count
+		last = b.Size
+		if count > rank {
+			return b.Size
+		}
+	}
+	// rank could reach total only for 100th percentile
+	// which belongs to the last non empty bucket.
+	return last
+}
+
+// histogram defines lock free allocation size histogram aggregator
+// that additionally keeps max traced large allocation size.
+type histogram struct {
+	counts [len(sizeClasses) + 1]int64
+	bytes  [len(sizeClasses) + 1]int64
+	max    int64
+}
+
+// record attributes provided number of allocations
+// of provided size to its size class bucket.
+func (h *histogram) record(size, count int64) {
+	i := sort.Search(len(sizeClasses), func(i int) bool {
+		return sizeClasses[i] >= size
+	})
+	atomic.AddInt64(&h.counts[i], count)
+	atomic.AddInt64(&h.bytes[i], size*count)
+	if i < len(sizeClasses) {
+		return
+	}
+	for max := atomic.LoadInt64(&h.max); size > max; max = atomic.LoadInt64(&h.max) {
+		if atomic.CompareAndSwapInt64(&h.max, max, size) {
+			break
+		}
+	}
+}
+
+func (h *histogram) reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+		atomic.StoreInt64(&h.bytes[i], 0)
+	}
+	atomic.StoreInt64(&h.max, 0)
+}
+
+// snapshot returns histogram buckets copy.
+func (h *histogram) snapshot() Histogram {
+	hist := make(Histogram, len(h.counts))
+	for i := range h.counts {
+		hist[i].Count = atomic.LoadInt64(&h.counts[i])
+		hist[i].Bytes = atomic.LoadInt64(&h.bytes[i])
+		switch {
+		case i < len(sizeClasses):
+			hist[i].Size = sizeClasses[i]
+		case hist[i].Count > 0:
+			hist[i].Size = atomic.LoadInt64(&h.max)
+		default:
+			hist[i].Size = Infinity
+		}
+	}
+	return hist
+}
@@ -0,0 +1,90 @@
+package gotcha
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// inuseRate and inuseNext define in use sampling rate and number of traced
+// allocations of in use sampling contexts left until the next tracked allocation.
+var inuseRate, inuseNext int64 = 1, 0
+
+// inuseSeq defines sequence number of the last tracked allocation,
+// so allocations tracked before context reset are never released from it.
+var inuseSeq int64
+
+// SetInUseSampleRate sets in use sampling rate, so on average every rate-th
+// traced allocation of in use sampling contexts, see `ContextWithInUseSampling`,
+// is tracked until it's freed and its values are scaled by the rate
+// to provide unbiased in use estimations. Similarly to `SetSampleRate` intervals
+// between tracked allocations are random and geometrically distributed.
+// By default every traced allocation is tracked, rate could be also set
+// with `GOTCHA_INUSE_SAMPLE_RATE` env var. Note that in use sampling rate
+// is global for all contexts and it's applied on top of malloc tracing sampling.
+func SetInUseSampleRate(rate int64) {
+	if rate < 1 {
+		rate = 1
+	}
+	atomic.StoreInt64(&inuseRate, rate)
+	atomic.StoreInt64(&inuseNext, interval(rate))
+}
+
+// InUseSampleRate returns current in use sampling rate.
+func InUseSampleRate() int64 {
+	return atomic.LoadInt64(&inuseRate)
+}
+
+// release defines tracked allocation that is released
+// from in use sampling contexts of the hierarchy once it's freed.
+type release struct {
+	ctx            *gotchactx
+	seq            int64
+	bytes, objects int64
+}
+
+// sampleInUse checks if current traced allocation of in use sampling context
+// should be tracked and returns its weight, zero weight means allocation isn't tracked.
+func sampleInUse() int64 {
+	return sampled(&inuseRate, &inuseNext)
+}
+
+// inusing returns whether context or any context in the hierarchy has in use sampling,
+// so its allocations are tracked until they are freed.
+func (ctx *gotchactx) inusing() bool {
+	for gctx := ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.inuse {
+			return true
+		}
+	}
+	return false
+}
+
+// track tracks provided allocation with provided sampling weight until it's freed,
+// it's called by malloc tracing for allocations made on behalf of traced goroutine,
+// see `malloc`, and it returns false if allocation can't be tracked.
+// Note that allocation values are calculated the same way as by alloc.
+func (ctx *gotchactx) track(p unsafe.Pointer, size uintptr, tp *tp, weight int64) bool {
+	bytes, objects := int64(size), int64(1)
+	if tp != nil && tp.size != 0 {
+		bytes = int64(tp.size)
+		objects = int64(size) / bytes
+	}
+	return cleanup(p, release{
+		ctx:     ctx,
+		seq:     atomic.AddInt64(&inuseSeq, 1),
+		bytes:   bytes * objects * weight,
+		objects: objects * weight,
+	})
+}
+
+// freed releases provided tracked allocation from in use sampling contexts
+// of the hierarchy that haven't been reset since the allocation was tracked,
+// it's called by runtime once tracked allocation is freed.
+func freed(r release) {
+	for gctx := r.ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.inuse && r.seq > atomic.LoadInt64(&gctx.fseq) {
+			atomic.AddInt64(&gctx.fbytes, r.bytes)
+			atomic.AddInt64(&gctx.fobjects, r.objects)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build go1.24
+// +build go1.24
+
+package gotcha
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// cleanups defines whether runtime supports cleanups
+// that are required for in use allocations tracking.
+const cleanups = true
+
+// cleanup attaches runtime cleanup to provided allocation
+// that calls freed with provided release once it's freed.
+// Note that unlike finalizers cleanups neither resurrect
+// nor conflict with finalizers and cleanups set by user code.
+func cleanup(p unsafe.Pointer, r release) bool {
+	runtime.AddCleanup((*byte)(p), freed, r)
+	return true
+}
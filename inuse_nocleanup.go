@@ -0,0 +1,16 @@
+//go:build !go1.24
+// +build !go1.24
+
+package gotcha
+
+import "unsafe"
+
+// cleanups defines whether runtime supports cleanups
+// that are required for in use allocations tracking,
+// they are not supported before go 1.24, so in use estimations match usage.
+const cleanups = false
+
+// cleanup never tracks allocations as runtime cleanups are not supported.
+func cleanup(p unsafe.Pointer, r release) bool {
+	return false
+}
@@ -1,13 +1,16 @@
 package gotcha
 
 import (
-	"C"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"runtime"
 	"strconv"
-	"unsafe"
-
-	"github.com/1pkg/golocal"
-	"github.com/1pkg/gomonkey"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // tp from `runtime._type`
@@ -15,45 +18,309 @@ type tp struct {
 	size uintptr
 }
 
-//go:linkname mallocgc runtime.mallocgc
-func mallocgc(size uintptr, tp *tp, needzero bool) unsafe.Pointer
+// sampleRate and sampleNext define malloc tracing sampling rate
+// and number of mallocgc calls left until the next sampled allocation.
+var sampleRate, sampleNext int64 = 1, 0
 
-// init patches main mallocgc allocation runtime entrypoint
-// it also sets goroutine local storage tracers capacity from env var
-// note that pacthing will only work on amd64 arch.
-func init() {
-	// set up local store for malloc
-	maxTracers := int64(golocal.DefaultCapacity)
-	if max, err := strconv.ParseInt(os.Getenv("GOTCHA_MAX_TRACERS"), 10, 64); err == nil {
-		maxTracers = max
-	}
-	ls := golocal.LStore(maxTracers)
-	// patch malloc with permanent decorator
-	gomonkey.PermanentDecorate(mallocgc, func(size uintptr, tp *tp, needzero bool) unsafe.Pointer {
-		// unfortunately we can't use local store direct calls here
-		// as it causes `unknown caller pc` stack fatal error.
-		id := ls.RLock()
-		gctxPtr, ok := ls.Store[id]
-		ls.RUnlock()
-		if ok {
-			// trace allocations for caller tracer goroutine.
-			bytes := int64(size)
-			objs := int64(1)
-			if tp != nil {
-				bytes = int64(tp.size)
-				objs = int64(size) / bytes
-			}
-			(*gotchactx)(unsafe.Pointer(gctxPtr)).Add(bytes, objs, 1)
+// seed defines malloc tracing sampling random generator state.
+var seed = uint64(time.Now().UnixNano()) | 1
+
+// SetSampleRate sets malloc tracing sampling rate,
+// so on average every rate-th allocation is traced and its values
+// are scaled by the rate to provide unbiased estimations.
+// Similarly to `runtime.MemProfileRate` intervals between traced allocations
+// are random and geometrically distributed, so periodic allocation patterns
+// are not aliased with the sampling rate.
+// By default every allocation is traced, rate could be also set
+// with `GOTCHA_SAMPLE_RATE` env var. Note that sampling rate
+// is global for all contexts and sampled context values are estimations.
+func SetSampleRate(rate int64) {
+	if rate < 1 {
+		rate = 1
+	}
+	atomic.StoreInt64(&sampleRate, rate)
+	atomic.StoreInt64(&sampleNext, interval(rate))
+}
+
+// SampleRate returns current malloc tracing sampling rate.
+func SampleRate() int64 {
+	return atomic.LoadInt64(&sampleRate)
+}
+
+// sample checks if current allocation should be traced
+// and returns its weight, zero weight means allocation is skipped.
+// Note that only allocation that exhausts the current interval is traced,
+// allocations that race with the next interval start are accounted on it.
+func sample() int64 {
+	return sampled(&sampleRate, &sampleNext)
+}
+
+// sampled checks if current allocation exhausts provided sampling interval
+// and returns provided sampling rate as its weight, zero weight means allocation is skipped.
+func sampled(rate, next *int64) int64 {
+	r := atomic.LoadInt64(rate)
+	if r == 1 {
+		return 1
+	}
+	if atomic.AddInt64(next, -1) != 0 {
+		return 0
+	}
+	atomic.AddInt64(next, interval(r))
+	return r
+}
+
+// interval returns random geometrically distributed number of allocations
+// with provided mean rate until the next sampled allocation.
+func interval(rate int64) int64 {
+	if rate == 1 {
+		return 1
+	}
+	// uniform random value in (0, 1] from top 53 random bits.
+	u := (float64(random()>>11) + 1) / (1 << 53)
+	return int64(math.Log(u)/math.Log(1-1/float64(rate))) + 1
+}
+
+// random returns next xorshift pseudo random value,
+// it doesn't allocate, so it could be safely used by malloc tracing.
+func random() uint64 {
+	for {
+		s := atomic.LoadUint64(&seed)
+		x := s ^ s<<13
+		x ^= x >> 7
+		x ^= x << 17
+		if atomic.CompareAndSwapUint64(&seed, s, x) {
+			return x
 		}
+	}
+}
+
+// alloc traces single mallocgc allocation made by goroutine with provided id
+// and scaled by provided sampling weight on the context and attributes it
+// to call sites, types and size histogram of the context hierarchy, it also returns
+// abort panic value if any hard stop context in the hierarchy has exceeded its limits
+// or limits exceeded error if any panic policy context in the hierarchy has exceeded its limits,
+// otherwise it puts allocating goroutine to sleep if any throttle policy context
+// in the hierarchy has exceeded its limits.
+// Note that panic value is returned and goroutine is throttled only for allocations
+// made by user code, otherwise the panic is postponed until the next such allocation
+// as neither panicking nor sleeping inside go runtime code is safe.
+func (ctx *gotchactx) alloc(id int64, size uintptr, tp *tp, weight int64) interface{} {
+	bytes := int64(size)
+	objs := int64(1)
+	if tp != nil && tp.size != 0 {
+		bytes = int64(tp.size)
+		objs = int64(size) / bytes
+	}
+	ctx.add(bytes, objs*weight, weight)
+	for gctx := ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.sites != nil {
+			gctx.sites.record(id, bytes, objs*weight, weight)
+		}
+		if gctx.types != nil {
+			gctx.types.record(id, tp, bytes, objs*weight, weight)
+		}
+		if gctx.hist != nil {
+			gctx.hist.record(int64(size), weight)
+		}
+	}
+	// abort allocating goroutine for the outermost exceeded hard stop context
+	// with preallocated panic value or panic it for the first exceeded panic policy context.
+	var abort *ContextAborted
+	for gctx := ctx; gctx != nil; gctx = gctx.pctx {
+		if gctx.abort != nil && gctx.Exceeded() {
+			abort = gctx.abort
+		}
+	}
+	pctx, tctx := ctx.panicking(), ctx.throttling()
+	if (abort == nil && pctx == nil && tctx == nil) || !abortable() {
 		return nil
-	}, 24, 53, []byte{
-		0x48, 0x83, 0xec, 0x28, // sub rsp,0x28
-		0x48, 0x8b, 0x44, 0x24, 0x30, // mov rax,QWORD PTR [rsp+0x30]
-		0x48, 0x89, 0x04, 0x24, // mov QWORD PTR [rsp],rax
-		0x48, 0x8b, 0x44, 0x24, 0x38, // mov rax,QWORD PTR [rsp+0x38]
-		0x48, 0x89, 0x44, 0x24, 0x08, // mov QWORD PTR [rsp],rax
-	}, []byte{
-		0x48, 0x83, 0xc4, 0x28, // add rsp,0x28
-		0x48, 0x81, 0xec, 0x98, 0x00, 0x00, 0x00, // sub rsp,0x98
-	})
+	}
+	if abort != nil {
+		return abort
+	}
+	if pctx != nil {
+		if err := pctx.raise(); err != nil {
+			return err
+		}
+	}
+	if tctx != nil {
+		time.Sleep(tctx.throttle)
+	}
+	return nil
+}
+
+// allocHelpers defines go runtime allocation entrypoints
+// that are called by compiler directly from user code
+// and that don't mutate any runtime structures before allocation.
+var allocHelpers = map[string]bool{
+	"runtime.mallocgc":          true,
+	"runtime.newobject":         true,
+	"runtime.newarray":          true,
+	"runtime.makeslice":         true,
+	"runtime.makeslicecopy":     true,
+	"runtime.growslice":         true,
+	"runtime.makechan":          true,
+	"runtime.makemap_small":     true,
+	"runtime.convT":             true,
+	"runtime.convTnoptr":        true,
+	"runtime.convT16":           true,
+	"runtime.convT32":           true,
+	"runtime.convT64":           true,
+	"runtime.convTstring":       true,
+	"runtime.convTslice":        true,
+	"runtime.rawstring":         true,
+	"runtime.rawstringtmp":      true,
+	"runtime.rawbyteslice":      true,
+	"runtime.rawruneslice":      true,
+	"runtime.stringtoslicebyte": true,
+	"runtime.stringtoslicerune": true,
+	"runtime.slicebytetostring": true,
+	"runtime.slicerunetostring": true,
+	"runtime.intstring":         true,
+	"runtime.concatstrings":     true,
+	"runtime.concatstring2":     true,
+	"runtime.concatstring3":     true,
+	"runtime.concatstring4":     true,
+	"runtime.concatstring5":     true,
+}
+
+// abortable checks if caller goroutine could be safely aborted at the traced allocation
+// which is only true when allocation is made by user code either directly
+// or through go runtime allocation helpers, as aborting go runtime code in the middle
+// of an operation, for example map assignment, could leave runtime structures corrupted.
+func abortable() bool {
+	var stack callstack
+	pcs := stack[:runtime.Callers(2, stack[:])]
+	// skip gotcha hook and mallocgc frames.
+	for i, pc := range pcs {
+		if f := runtime.FuncForPC(pc - 1); f != nil && (f.Name() == "runtime.mallocgc" || f.Name() == mallocgcTrampolineName) {
+			pcs = pcs[i+1:]
+			break
+		}
+	}
+	for _, pc := range pcs {
+		f := runtime.FuncForPC(pc - 1)
+		if f == nil {
+			return false
+		}
+		if name := f.Name(); !allocHelpers[name] {
+			return !strings.HasPrefix(name, "runtime.") && !strings.HasPrefix(name, "internal/runtime/")
+		}
+	}
+	return false
+}
+
+// ErrNotInstalled defines error returned by status and trace
+// when malloc tracing isn't installed.
+var ErrNotInstalled = errors.New("malloc tracing isn't installed")
+
+// ErrDegraded defines error returned by install, status and trace
+// when malloc tracing is installed but toolchain size specialized malloc
+// allocation functions can't be patched, so small objects allocations
+// bypass mallocgc and are not traced and contexts usage is under counted.
+// Size specialized malloc could be disabled by building program
+// with `GOEXPERIMENT=nosizespecializedmalloc`.
+var ErrDegraded = errors.New("malloc tracing is degraded as small objects allocations bypass mallocgc with size specialized malloc")
+
+// patched defines whether mallocgc is patched, it's checked
+// before any goroutine local store access by contexts, so goroutine
+// local store is never touched unless malloc tracing is installed.
+var patched int32
+
+// install defines malloc tracing installation state
+// that guards mallocgc patching and restoring.
+var install struct {
+	sync.RWMutex
+	// err defines last malloc tracing installation error.
+	err error
+	// unpatch restores original mallocgc when it has been patched.
+	unpatch func() error
+}
+
+// Install patches mallocgc allocation runtime entrypoint together with
+// toolchain size specialized malloc allocation functions if any, so allocations
+// are traced by gotcha contexts, it's no-op if malloc tracing is already installed.
+// Note that patching will only work on amd64 and arm64 archs
+// and only after mallocgc entry instructions have been verified,
+// otherwise runtime is left untouched and error with the reason is returned.
+// Note that if toolchain size specialized malloc functions can't be patched
+// malloc tracing is still installed but `ErrDegraded` is returned, see `Status`.
+// Note that installation isn't synchronized with concurrently running
+// allocations so it's better to install malloc tracing as early as possible,
+// see `Uninstall` for details on patching running program.
+func Install() error {
+	install.Lock()
+	defer install.Unlock()
+	if install.unpatch != nil {
+		return install.err
+	}
+	unpatch, err := patch()
+	if err != nil {
+		install.err = fmt.Errorf("%w: %v", ErrNotInstalled, err)
+		return install.err
+	}
+	install.err, install.unpatch = nil, unpatch
+	atomic.StoreInt32(&patched, 1)
+	if specialized && atomic.LoadInt32(&dispatched) == 0 {
+		install.err = ErrDegraded
+	}
+	return install.err
+}
+
+// Uninstall restores original mallocgc allocation runtime entrypoint,
+// it's no-op if malloc tracing isn't installed.
+// Note that mallocgc code is rewritten while other goroutines could be executing it,
+// on go 1.17+ it's done with single atomic store that keeps mallocgc instructions
+// boundaries, so tracing could be toggled in running program, but allocations
+// that have already entered malloc tracing are still traced after uninstallation.
+// On older go runtimes mallocgc code isn't rewritten atomically, so both `Install`
+// and `Uninstall` must not be called while program could allocate concurrently.
+func Uninstall() error {
+	install.Lock()
+	defer install.Unlock()
+	if install.unpatch == nil {
+		return nil
+	}
+	if err := install.unpatch(); err != nil {
+		return err
+	}
+	install.err, install.unpatch = nil, nil
+	atomic.StoreInt32(&patched, 0)
+	return nil
+}
+
+// Enabled returns true if malloc tracing is installed
+// and all allocations are traced by gotcha contexts,
+// so it returns false if malloc tracing is degraded.
+func Enabled() bool {
+	return Status() == nil
+}
+
+// Status returns nil if malloc tracing is installed,
+// `ErrDegraded` if malloc tracing is installed but small objects allocations
+// are not traced or error wrapping `ErrNotInstalled` with the reason otherwise.
+// Note that when malloc tracing isn't installed runtime is left untouched
+// and traces keep working with zero usage unless it's added manually.
+func Status() error {
+	install.RLock()
+	defer install.RUnlock()
+	switch {
+	case install.err != nil:
+		return install.err
+	case install.unpatch != nil:
+		return nil
+	default:
+		return ErrNotInstalled
+	}
+}
+
+// init sets malloc tracing sampling and in use sampling rates from env vars
+// note that mallocgc isn't patched until `Install` is called.
+func init() {
+	if rate, err := strconv.ParseInt(os.Getenv("GOTCHA_SAMPLE_RATE"), 10, 64); err == nil {
+		SetSampleRate(rate)
+	}
+	if rate, err := strconv.ParseInt(os.Getenv("GOTCHA_INUSE_SAMPLE_RATE"), 10, 64); err == nil {
+		SetInUseSampleRate(rate)
+	}
 }
@@ -0,0 +1,134 @@
+//go:build (linux || darwin) && !race && !msan && !asan
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// mallocgcCheck defines stack check slots, every slot branches to patched function
+// morestack with flags of its stack check or loads patched function resume address
+// and branches to mallocgcTrampoline, it's implemented in assembly
+// as slots that are filled on patching.
+func mallocgcCheck()
+
+// mallocgcTail branches back to patched function resume address, it's implemented in assembly.
+func mallocgcTail()
+
+// trampolines returns stack check slots and trampoline abi0 addresses,
+// it's implemented in assembly.
+func trampolines() (check, trampoline uintptr)
+
+// flush flushes data and instruction caches for provided address,
+// it's implemented in assembly.
+func flush(addr uintptr)
+
+// patch patches stack check branches of mallocgc and size specialized runtime
+// allocation functions with branches into stack check slots that branch to function morestack
+// or into trampoline that calls malloc tracing and resumes original function right after the check.
+// Note that malloc tracing runs after the stack check, so function
+// restarts after stack growth don't trace the same allocation twice.
+// Patch returns unpatch function that restores original stack check branches.
+func patch() (func() error, error) {
+	return entrypoints(hook)
+}
+
+// hook prepares stack check slot with provided index for function with provided name and entry
+// and returns its entrypoint that patches and unpatches its stack check branch.
+func hook(name string, entry uintptr, slot int) (entrypoint, error) {
+	code := text(entry, 12)
+	target, ok := stackcheck(code)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: unexpected %s stack check", name)
+	}
+	bls := binary.LittleEndian.Uint32(code[8:])
+	check, trampoline := trampolines()
+	check += uintptr(slot * mallocgcCheckSize)
+	resume := entry + 12
+	// B.HI 2(PC), B morestack, LDR resume, R17, B trampoline, resume
+	morestack, ok := branch(check+4, entry+uintptr(target))
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s morestack is out of branch range", name)
+	}
+	tramp, ok := branch(check+12, trampoline)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s trampoline is out of branch range", name)
+	}
+	// B check
+	jump, ok := branch(entry+8, check)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s check is out of branch range", name)
+	}
+	// slot is rewritten only on the first patch as it could be still
+	// executed by goroutines that entered it before previous unpatch.
+	for i, insn := range []uint32{0x54000048, morestack, 0x58000051, tramp, uint32(resume), uint32(uint64(resume) >> 32)} {
+		addr := check + uintptr(i*4)
+		if binary.LittleEndian.Uint32(text(addr, 4)) == insn {
+			continue
+		}
+		if err := writeInsn(addr, insn); err != nil {
+			return entrypoint{}, err
+		}
+	}
+	return entrypoint{
+		resume:  resume,
+		patch:   func() error { return writeInsn(entry+8, jump) },
+		unpatch: func() error { return writeInsn(entry+8, bls) },
+	}, nil
+}
+
+// stackcheck parses small frame stack check at provided function code start
+// `MOVD 16(g), Rt; CMP Rt, RSP; BLS morestack`
+// and returns morestack branch target offset.
+func stackcheck(code []byte) (target int64, ok bool) {
+	if len(code) < 12 {
+		return 0, false
+	}
+	ldr := binary.LittleEndian.Uint32(code)
+	cmp := binary.LittleEndian.Uint32(code[4:])
+	bls := binary.LittleEndian.Uint32(code[8:])
+	// LDR Xt, [X28, #16]
+	rt := ldr & 0x1f
+	if ldr&^0x1f != 0xf9400b80 {
+		return 0, false
+	}
+	// SUBS XZR, SP, Xt, UXTX
+	if cmp != 0xeb2063ff|rt<<16 {
+		return 0, false
+	}
+	// B.LS imm19
+	if bls&0xff00001f != 0x54000009 {
+		return 0, false
+	}
+	return 8 + int64(int32(bls<<8)>>13)*4, true
+}
+
+// branch returns unconditional branch instruction
+// from provided address to provided target address.
+func branch(addr, target uintptr) (uint32, bool) {
+	offset := int64(target) - int64(addr)
+	if offset%4 != 0 || offset < -(1<<27) || offset >= 1<<27 {
+		return 0, false
+	}
+	return uint32(0x14000000) | uint32(offset>>2)&0x3ffffff, true
+}
+
+// writeInsn atomically writes single instruction to provided text address
+// and flushes caches for it, so it could be executed concurrently.
+func writeInsn(addr uintptr, insn uint32) error {
+	code := text(addr, 4)
+	if err := writable(addr, len(code), func() {
+		atomic.StoreUint32((*uint32)(unsafe.Pointer(&code[0])), insn)
+	}); err != nil {
+		return err
+	}
+	flush(addr)
+	return nil
+}
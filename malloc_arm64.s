@@ -0,0 +1,41 @@
+//go:build (linux || darwin) && !race && !msan && !asan
+// +build linux darwin
+// +build !race,!msan,!asan
+
+#include "textflag.h"
+
+// SLOT defines single 32 bytes stack check slot of BRK instructions.
+#define SLOT \
+	WORD $0xd4200000; WORD $0xd4200000; WORD $0xd4200000; WORD $0xd4200000; \
+	WORD $0xd4200000; WORD $0xd4200000; WORD $0xd4200000; WORD $0xd4200000
+
+// func mallocgcCheck()
+TEXT ·mallocgcCheck(SB), NOSPLIT|NOFRAME, $0-0
+	// slots for patched functions morestack branches, resume addresses
+	// and branches to trampoline that are filled on patching.
+	SLOT; SLOT; SLOT; SLOT
+	SLOT; SLOT; SLOT; SLOT
+	SLOT; SLOT; SLOT; SLOT
+	SLOT; SLOT; SLOT; SLOT
+
+// func mallocgcTail()
+TEXT ·mallocgcTail(SB), NOSPLIT|NOFRAME, $0-0
+	JMP (R17)
+
+// func trampolines() (check, trampoline uintptr)
+TEXT ·trampolines(SB), NOSPLIT, $0-16
+	MOVD $·mallocgcCheck(SB), R0
+	MOVD R0, check+0(FP)
+	MOVD $·mallocgcTrampoline(SB), R0
+	MOVD R0, trampoline+8(FP)
+	RET
+
+// func flush(addr uintptr)
+TEXT ·flush(SB), NOSPLIT, $0-8
+	MOVD addr+0(FP), R0
+	WORD $0xd50b7b20 // DC CVAU, R0
+	WORD $0xd5033b9f // DSB ISH
+	WORD $0xd50b7520 // IC IVAU, R0
+	WORD $0xd5033b9f // DSB ISH
+	WORD $0xd5033fdf // ISB
+	RET
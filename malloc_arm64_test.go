@@ -0,0 +1,66 @@
+//go:build (linux || darwin) && !race && !msan && !asan
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStackCheck(t *testing.T) {
+	table := map[string]struct {
+		code   []byte
+		target int64
+		ok     bool
+	}{
+		"small frame stack check should be parsed": {
+			code:   []byte{0x90, 0x0b, 0x40, 0xf9, 0xff, 0x63, 0x30, 0xeb, 0x69, 0x0d, 0x00, 0x54},
+			target: 8 + 107*4,
+			ok:     true,
+		},
+		"small frame stack check with other register should be parsed": {
+			code:   []byte{0x81, 0x0b, 0x40, 0xf9, 0xff, 0x63, 0x21, 0xeb, 0xe9, 0xff, 0xff, 0x54},
+			target: 8 - 4,
+			ok:     true,
+		},
+		"stack check with mismatched register should be rejected": {
+			code: []byte{0x90, 0x0b, 0x40, 0xf9, 0xff, 0x63, 0x31, 0xeb, 0x69, 0x0d, 0x00, 0x54},
+		},
+		"stack check with other branch condition should be rejected": {
+			code: []byte{0x90, 0x0b, 0x40, 0xf9, 0xff, 0x63, 0x30, 0xeb, 0x68, 0x0d, 0x00, 0x54},
+		},
+		"unexpected stack guard load should be rejected": {
+			code: []byte{0x90, 0x0f, 0x40, 0xf9, 0xff, 0x63, 0x30, 0xeb, 0x69, 0x0d, 0x00, 0x54},
+		},
+		"truncated stack check should be rejected": {
+			code: []byte{0x90, 0x0b, 0x40, 0xf9, 0xff, 0x63, 0x30, 0xeb},
+		},
+	}
+	for tname, tcase := range table {
+		t.Run(tname, func(t *testing.T) {
+			target, ok := stackcheck(tcase.code)
+			require.Equal(t, tcase.ok, ok)
+			if ok {
+				require.Equal(t, tcase.target, target)
+			}
+		})
+	}
+}
+
+func TestBranch(t *testing.T) {
+	insn, ok := branch(0x1000, 0x1008)
+	require.True(t, ok)
+	require.Equal(t, uint32(0x14000002), insn)
+	insn, ok = branch(0x1008, 0x1000)
+	require.True(t, ok)
+	require.Equal(t, uint32(0x17fffffe), insn)
+	_, ok = branch(0x1000, 0x1002)
+	require.False(t, ok)
+	_, ok = branch(0, 1<<27)
+	require.False(t, ok)
+}
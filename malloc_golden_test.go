@@ -0,0 +1,103 @@
+package gotcha_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/1pkg/gotcha/gotchatest"
+)
+
+// goldenTypes defines trace types allocation budgets golden file.
+const goldenTypes = "testdata/trace_types.json"
+
+func TestTraceTypesGolden(t *testing.T) {
+	// golden budgets can only be asserted when all allocations are traced.
+	if err := gotcha.Install(); err != nil {
+		t.Skip(err)
+	}
+	type sobj struct {
+		a, b int64
+	}
+	table := map[string]func(){
+		"trace new object alloc": func() {
+			var v *sobj
+			for i := 0; i < 1000; i++ {
+				v = new(sobj)
+			}
+			v.a = 0
+			v.b = 0
+		},
+		"trace new object alloc address": func() {
+			var v *sobj
+			for i := 0; i < 1000; i++ {
+				v = &sobj{a: 1, b: 1}
+			}
+			v.a = 0
+			v.b = 0
+		},
+		"trace new object alloc reflect": func() {
+			var v *sobj = &sobj{}
+			tp := reflect.ValueOf(*v).Type()
+			for i := 0; i < 100; i++ {
+				vref := reflect.New(tp)
+				v = vref.Interface().(*sobj)
+			}
+			v.a = 0
+			v.b = 0
+		},
+		"trace make slice alloc": func() {
+			var v []int64
+			for i := 0; i < 1000; i++ {
+				v = make([]int64, 1, 10)
+			}
+			v[0] = 0
+		},
+		"trace make slice copy alloc": func() {
+			var v []int64
+			vc := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+			for i := 0; i < 1000; i++ {
+				v = make([]int64, 10)
+				copy(v, vc)
+			}
+			v[0] = 0
+		},
+		"trace make slice append alloc": func() {
+			var v []int64
+			for i := 0; i < 1000; i++ {
+				v = make([]int64, 10)
+				v = append(v, 1)
+			}
+			v[0] = 0
+		},
+		"trace string bytes alloc": func() {
+			cs := "foo | | bar"
+			var v []byte
+			for i := 0; i < 1000; i++ {
+				v = []byte(cs)
+			}
+			_ = len(v)
+		},
+		"trace string runes alloc": func() {
+			cs := "foo | | bar"
+			var v []rune
+			for i := 0; i < 1000; i++ {
+				v = []rune(cs)
+			}
+			_ = len(v)
+		},
+		"trace bytes string alloc": func() {
+			cb := []byte("foo | | bar")
+			var v string
+			for i := 0; i < 1000; i++ {
+				v = string(cb)
+			}
+			_ = len(v)
+		},
+	}
+	for tname, tcase := range table {
+		t.Run(tname, func(t *testing.T) {
+			gotchatest.AssertGolden(t, goldenTypes, tname, tcase)
+		})
+	}
+}
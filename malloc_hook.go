@@ -0,0 +1,308 @@
+//go:build (amd64 || arm64) && (linux || darwin) && !race && !msan && !asan
+// +build amd64 arm64
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/1pkg/golocal"
+	"github.com/modern-go/gls"
+)
+
+//go:linkname mallocgc runtime.mallocgc
+func mallocgc(size uintptr, tp *tp, needzero bool) unsafe.Pointer
+
+// mallocgcCheckSize defines size in bytes of single stack check slot
+// and mallocgcChecks defines number of stack check slots
+// for patched runtime allocation functions.
+const (
+	mallocgcCheckSize = 32
+	mallocgcChecks    = 16
+)
+
+// mallocgcResume defines mallocgc address right after stack check branch
+// which is used by malloc tracing to tell mallocgc from size specialized functions.
+var mallocgcResume uintptr
+
+// dispatched defines whether size specialized runtime allocation functions are patched,
+// in which case mallocgc doesn't trace small allocations dispatched to them.
+var dispatched int32
+
+// entrypoint defines patched runtime allocation function address
+// right after its stack check branch together with functions
+// that patch and unpatch its stack check branch.
+type entrypoint struct {
+	resume         uintptr
+	patch, unpatch func() error
+}
+
+// entrypoints patches mallocgc and size specialized runtime allocation functions
+// if any with provided arch specific hook that prepares stack check slot
+// with provided index for provided function and returns its entrypoint.
+// Note that size specialized functions are patched before mallocgc and only all together,
+// otherwise small objects allocations are not traced and malloc tracing is degraded.
+// Entrypoints returns unpatch function that restores all patched functions.
+func entrypoints(hook func(name string, entry uintptr, slot int) (entrypoint, error)) (func() error, error) {
+	entry := reflect.ValueOf(mallocgc).Pointer()
+	if f := runtime.FuncForPC(entry); f == nil || f.Name() != "runtime.mallocgc" || f.Entry() != entry {
+		return nil, errors.New("gotcha: can't resolve runtime.mallocgc entry")
+	}
+	mep, err := hook("runtime.mallocgc", entry, 0)
+	if err != nil {
+		return nil, err
+	}
+	var seps []entrypoint
+	if entries, ok := lookup(entry, specializedEntrypoints); ok && len(entries) < mallocgcChecks {
+		for i, sentry := range entries {
+			sep, err := hook(specializedEntrypoints[i], sentry, i+1)
+			if err != nil {
+				seps = nil
+				break
+			}
+			seps = append(seps, sep)
+		}
+	}
+	restore := func(eps []entrypoint) error {
+		for _, ep := range eps {
+			if err := ep.unpatch(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, sep := range seps {
+		if err := sep.patch(); err != nil {
+			_ = restore(seps[:i])
+			return nil, err
+		}
+	}
+	mallocgcResume = mep.resume
+	if len(seps) > 0 {
+		atomic.StoreInt32(&dispatched, 1)
+	}
+	if err := mep.patch(); err != nil {
+		_ = restore(seps)
+		atomic.StoreInt32(&dispatched, 0)
+		return nil, err
+	}
+	return func() error {
+		if err := mep.unpatch(); err != nil {
+			return err
+		}
+		if err := restore(seps); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&dispatched, 0)
+		return nil
+	}, nil
+}
+
+// lookup resolves entries of provided runtime functions by walking module functions
+// around provided function entry, as unexported runtime functions can't be linknamed
+// on modern toolchains, it returns false if any function can't be resolved.
+func lookup(from uintptr, names []string) ([]uintptr, bool) {
+	index := make(map[string]int, len(names))
+	for i, name := range names {
+		index[name] = i
+	}
+	entries := make([]uintptr, len(names))
+	left := len(names)
+	visit := func(entry uintptr) {
+		f := runtime.FuncForPC(entry)
+		if f == nil {
+			return
+		}
+		if i, ok := index[f.Name()]; ok && entries[i] == 0 {
+			entries[i] = entry
+			left--
+		}
+	}
+	// previous function always contains address right before function entry.
+	for f := runtime.FuncForPC(from); f != nil && left > 0; f = runtime.FuncForPC(f.Entry() - 1) {
+		visit(f.Entry())
+	}
+	for entry := from; entry != 0 && left > 0; entry = next(entry) {
+		visit(entry)
+	}
+	return entries, left == 0
+}
+
+// next returns entry of module function that follows function with provided entry
+// or zero if there is no such function, it's found by exponential search
+// followed by binary search of the first address outside of provided function.
+func next(entry uintptr) uintptr {
+	within := func(pc uintptr) bool {
+		f := runtime.FuncForPC(pc)
+		return f != nil && f.Entry() == entry
+	}
+	lo, hi := entry, entry+1
+	for within(hi) {
+		lo, hi = hi, entry+(hi-entry)*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if within(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if f := runtime.FuncForPC(hi); f != nil && f.Entry() == hi {
+		return hi
+	}
+	return 0
+}
+
+// text returns raw memory slice of provided size at provided text address.
+func text(addr uintptr, size int) (mem []byte) {
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&mem))
+	h.Data, h.Len, h.Cap = addr, size, size
+	return
+}
+
+// lstore defines malloc tracing goroutine local store.
+var lstore *golocal.LocalStore
+
+// goid returns caller goroutine id.
+func goid() int64 {
+	return gls.GoID()
+}
+
+// binded returns caller goroutine id and its local store binding if any.
+// Note that local store keeps only binding address which is always
+// kept alive by the caller trace, see `bind`.
+func binded() (int64, *binding) {
+	id := lstore.RLock()
+	bptr, ok := lstore.Store[id]
+	lstore.RUnlock()
+	if !ok {
+		return id, nil
+	}
+	return id, (*binding)(unsafe.Pointer(bptr))
+}
+
+// bind binds provided gotcha context to caller goroutine local store
+// and returns the binding that has to be kept alive until it's unbound.
+// Previous caller goroutine binding, if any, is kept by the new binding
+// and its malloc tracing is guarded while the new binding is allocated.
+// Bind returns nil without touching local store if malloc tracing isn't installed.
+// Note that bind isn't inlined, so the binding always escapes to heap
+// as local store keeps only its address.
+//
+//go:noinline
+func bind(gctx *gotchactx) *binding {
+	if atomic.LoadInt32(&patched) == 0 {
+		return nil
+	}
+	_, prev := binded()
+	if prev != nil {
+		prev.tracing = true
+	}
+	b := &binding{gctx: gctx, prev: prev}
+	if prev != nil {
+		prev.tracing = false
+	}
+	lstore.Set(uintptr(unsafe.Pointer(b)))
+	return b
+}
+
+// unbind unbinds provided binding from caller goroutine local store
+// and restores previous caller goroutine binding if any.
+func unbind(b *binding) {
+	switch {
+	case b == nil:
+	case b.prev != nil:
+		lstore.Set(uintptr(unsafe.Pointer(b.prev)))
+	default:
+		lstore.Del()
+	}
+}
+
+// guard suspends malloc tracing of caller goroutine binding if any
+// and returns the binding that has to be resumed with unguard,
+// so allocations made by context bookkeeping are never accounted on it.
+// Guard returns nil without touching local store if malloc tracing isn't installed.
+func guard() *binding {
+	if atomic.LoadInt32(&patched) == 0 {
+		return nil
+	}
+	_, b := binded()
+	if b == nil || b.tracing {
+		return nil
+	}
+	b.tracing = true
+	return b
+}
+
+// unguard resumes malloc tracing of provided binding suspended by guard.
+func unguard(b *binding) {
+	if b != nil {
+		b.tracing = false
+	}
+}
+
+// malloc traces single mallocgc call for caller goroutine if it's bound to any context,
+// it's called by arch specific mallocgc patch right before original mallocgc
+// or size specialized runtime allocation function with provided resume address.
+// For in use sampling contexts malloc could also allocate traced allocation itself
+// to track it until it's freed, see `ContextWithInUseSampling`, in which case
+// the allocation is returned and arch specific mallocgc patch returns it
+// from mallocgc instead of resuming original mallocgc.
+// Note that malloc doesn't check installation state as it could be called
+// only while mallocgc is patched.
+func malloc(size uintptr, tp *tp, needzero bool, resume uintptr) unsafe.Pointer {
+	// skip mallocgc small allocations that are traced by size specialized functions.
+	if resume == mallocgcResume && size != 0 && size <= specializedMax && atomic.LoadInt32(&dispatched) == 1 {
+		return nil
+	}
+	// skip not sampled allocations before any local store access.
+	weight := sample()
+	if weight == 0 {
+		return nil
+	}
+	// unfortunately we can't use local store direct calls here
+	// as it causes `unknown caller pc` stack fatal error.
+	id, b := binded()
+	// skip allocations made by malloc tracing itself
+	// so they are never accounted on traced contexts.
+	if b == nil || b.tracing {
+		return nil
+	}
+	// trace allocations for caller tracer goroutine.
+	b.tracing = true
+	v := b.gctx.alloc(id, size, tp, weight)
+	var p unsafe.Pointer
+	// track only allocations made by user code as runtime cleanup
+	// can't be safely attached while go runtime code is in the middle of an operation.
+	if v == nil && cleanups && size != 0 && b.gctx.inusing() {
+		if iweight := sampleInUse(); iweight != 0 && abortable() {
+			p = mallocgc(size, tp, needzero)
+			_ = b.gctx.track(p, size, tp, weight*iweight)
+		}
+	}
+	b.tracing = false
+	if v != nil {
+		panic(v)
+	}
+	return p
+}
+
+// init sets goroutine local storage tracers capacity from env var.
+func init() {
+	maxTracers := int64(golocal.DefaultCapacity)
+	if max, err := strconv.ParseInt(os.Getenv("GOTCHA_MAX_TRACERS"), 10, 64); err == nil {
+		maxTracers = max
+	}
+	lstore = golocal.LStore(maxTracers)
+}
@@ -0,0 +1,32 @@
+//go:build (amd64 || arm64) && (linux || darwin) && !race && !msan && !asan
+// +build amd64 arm64
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	entry := reflect.ValueOf(mallocgc).Pointer()
+	names := []string{"runtime.newobject", "runtime.mallocgc", "runtime.makeslice"}
+	names = append(names, specializedEntrypoints...)
+	entries, ok := lookup(entry, names)
+	require.True(t, ok)
+	for i, name := range names {
+		f := runtime.FuncForPC(entries[i])
+		require.NotNil(t, f)
+		require.Equal(t, name, f.Name())
+		require.Equal(t, entries[i], f.Entry())
+	}
+	_, ok = lookup(entry, []string{"runtime.mallocgc", "runtime.gotcha"})
+	require.False(t, ok)
+}
@@ -0,0 +1,9 @@
+//go:build race || msan || asan
+// +build race msan asan
+
+package gotcha
+
+// instrumented defines whether program is built with race, msan or asan instrumentation,
+// in which case checkptr instrumentation rejects goroutine local store pointer arithmetic
+// and runtime allocations are instrumented, so malloc tracing is never installed.
+const instrumented = true
@@ -0,0 +1,33 @@
+//go:build (amd64 || arm64) && (linux || darwin) && !race && !msan && !asan
+// +build amd64 arm64
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import "syscall"
+
+// write writes provided code to provided text address
+// temporarily making text pages writable.
+// Note that write isn't atomic, so it should only be used
+// for text that isn't executed concurrently.
+func write(addr uintptr, code []byte) error {
+	return writable(addr, len(code), func() {
+		copy(text(addr, len(code)), code)
+	})
+}
+
+// writable calls provided store function while text pages
+// of provided text address range are temporarily writable.
+func writable(addr uintptr, size int, store func()) error {
+	psize := uintptr(syscall.Getpagesize())
+	page := addr &^ (psize - 1)
+	mem := text(page, int((addr+uintptr(size)-page+psize-1)&^(psize-1)))
+	if err := syscall.Mprotect(mem, syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC); err != nil {
+		return err
+	}
+	store()
+	return syscall.Mprotect(mem, syscall.PROT_READ|syscall.PROT_EXEC)
+}
@@ -0,0 +1,7 @@
+//go:build !race && !msan && !asan
+// +build !race,!msan,!asan
+
+package gotcha
+
+// instrumented defines whether program is built with race, msan or asan instrumentation.
+const instrumented = false
@@ -0,0 +1,48 @@
+//go:build (!amd64 && !arm64) || (!linux && !darwin) || race || msan || asan
+// +build !amd64,!arm64 !linux,!darwin race msan asan
+
+package gotcha
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// goids defines sequence of unique lock owner ids.
+var goids int64
+
+// goid returns unique lock owner id on every call instead of caller goroutine id
+// as there is no malloc tracing that could reenter locked sections.
+func goid() int64 {
+	return atomic.AddInt64(&goids, 1)
+}
+
+// dispatched is never set on unsupported platforms and instrumented builds
+// as size specialized malloc functions are never patched.
+var dispatched int32
+
+// bind is no-op on unsupported platforms as there is no malloc tracing.
+func bind(gctx *gotchactx) *binding {
+	return nil
+}
+
+// unbind is no-op on unsupported platforms as there is no malloc tracing.
+func unbind(b *binding) {}
+
+// guard is no-op on unsupported platforms as there is no malloc tracing.
+func guard() *binding {
+	return nil
+}
+
+// unguard is no-op on unsupported platforms as there is no malloc tracing.
+func unguard(b *binding) {}
+
+// patch always fails on unsupported platforms and instrumented builds,
+// so gotcha keeps the same api and runtime is left untouched
+// while contexts still enforce limits for manually added usage.
+func patch() (func() error, error) {
+	if instrumented {
+		return nil, errors.New("gotcha: malloc tracing isn't supported in race, msan or asan instrumented builds")
+	}
+	return nil, errors.New("gotcha: malloc tracing isn't supported on this platform")
+}
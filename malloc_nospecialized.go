@@ -0,0 +1,14 @@
+//go:build !goexperiment.sizespecializedmalloc || race || msan || asan
+// +build !goexperiment.sizespecializedmalloc race msan asan
+
+package gotcha
+
+// specialized defines whether toolchain size specialized malloc is enabled.
+const specialized = false
+
+// specializedMax defines max allocation size that mallocgc dispatches
+// to size specialized runtime allocation functions.
+const specializedMax = 0
+
+// specializedEntrypoints defines size specialized runtime allocation functions.
+var specializedEntrypoints []string
@@ -0,0 +1,157 @@
+//go:build go1.17 && (linux || darwin) && !race && !msan && !asan
+// +build go1.17
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// mallocgcBlockSize defines size in bytes of patched function entry block
+// that is rewritten with single atomic store on patching.
+const mallocgcBlockSize = 16
+
+// mallocgcCheck defines stack check slots, every slot branches to patched function
+// morestack with flags of its stack check or loads patched function resume address
+// and jumps to mallocgcTrampoline, it's implemented in assembly
+// as slots that are filled on patching.
+func mallocgcCheck()
+
+// mallocgcTrampoline calls malloc tracing with patched function register arguments
+// and tail jumps to mallocgcTail or returns allocation made by malloc tracing
+// directly to patched function caller if any, it's implemented in assembly.
+// Note that trampoline is not supposed to be called directly
+// as it's jumped into from stack check slots.
+func mallocgcTrampoline()
+
+// mallocgcTail jumps back to patched function resume address, it's implemented in assembly.
+func mallocgcTail()
+
+// trampolines returns stack check slots and trampoline abi0 addresses,
+// it's implemented in assembly.
+func trampolines() (check, trampoline uintptr)
+
+// store16 atomically stores provided 16 bytes to provided 16 bytes aligned address
+// with LOCK CMPXCHG16B, it's implemented in assembly.
+func store16(addr uintptr, lo, hi uint64)
+
+// patch patches stack check branches of mallocgc and size specialized runtime
+// allocation functions with jumps into stack check slots that branch to function morestack
+// or jump into trampoline that calls malloc tracing and resumes original function right after the check.
+// Note that malloc tracing runs after the stack check, so function
+// restarts after stack growth don't trace the same allocation twice.
+// Note that only stack check branch is replaced with the jump of the same length,
+// so function instructions boundaries are kept and whole function entry block
+// is rewritten with single atomic store while function could be executed concurrently.
+// Patch returns unpatch function that restores original stack check branches.
+func patch() (func() error, error) {
+	return entrypoints(hook)
+}
+
+// hook prepares stack check slot with provided index for function with provided name and entry
+// and returns its entrypoint that patches and unpatches its stack check branch.
+func hook(name string, entry uintptr, slot int) (entrypoint, error) {
+	code := text(entry, mallocgcCheckSize)
+	cmp, jbe, target, ok := stackcheck(code)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: unexpected %s stack check", name)
+	}
+	if jbe != 6 || cmp+jbe > mallocgcBlockSize || entry%mallocgcBlockSize != 0 {
+		return entrypoint{}, fmt.Errorf("gotcha: %s stack check branch can't be patched atomically", name)
+	}
+	check, trampoline := trampolines()
+	check += uintptr(slot * mallocgcCheckSize)
+	resume := entry + uintptr(cmp+jbe)
+	// JBE morestack, LEAQ resume(RIP), R12, JMP trampoline
+	code, ok = rel32(nil, check, entry+uintptr(target), 0x0f, 0x86)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s morestack is out of jump range", name)
+	}
+	code, ok = rel32(code, check, resume, 0x4c, 0x8d, 0x25)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s resume is out of jump range", name)
+	}
+	code, ok = rel32(code, check, trampoline, 0xe9)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s trampoline is out of jump range", name)
+	}
+	// JMP check padded with NOP
+	jmp, ok := rel32(nil, entry+uintptr(cmp), check, 0xe9)
+	if !ok {
+		return entrypoint{}, fmt.Errorf("gotcha: %s check is out of jump range", name)
+	}
+	jmp = append(jmp, 0x90)
+	orig := append([]byte(nil), text(entry, mallocgcBlockSize)...)
+	block := append([]byte(nil), orig...)
+	copy(block[cmp:], jmp)
+	// slot is rewritten only on the first patch as it could be still
+	// executed by goroutines that entered it before previous unpatch.
+	if !bytes.Equal(text(check, len(code)), code) {
+		if err := write(check, code); err != nil {
+			return entrypoint{}, err
+		}
+	}
+	return entrypoint{
+		resume:  resume,
+		patch:   func() error { return store(entry, block) },
+		unpatch: func() error { return store(entry, orig) },
+	}, nil
+}
+
+// store atomically stores provided function entry block to provided text address.
+func store(addr uintptr, block []byte) error {
+	return writable(addr, len(block), func() {
+		store16(addr, binary.LittleEndian.Uint64(block), binary.LittleEndian.Uint64(block[8:]))
+	})
+}
+
+// stackcheck parses regabi stack check at provided function code start
+// and returns length of position independent stack guard compare
+// together with length of following morestack branch and its target offset.
+func stackcheck(code []byte) (cmp, jbe int, target int64, ok bool) {
+	switch {
+	// CMPQ SP, 16(R14)
+	case bytes.HasPrefix(code, []byte{0x49, 0x3b, 0x66, 0x10}):
+		cmp = 4
+	// LEAQ -disp8(SP), R12; CMPQ R12, 16(R14)
+	case bytes.HasPrefix(code, []byte{0x4c, 0x8d, 0x64, 0x24}) && len(code) > 5 && bytes.HasPrefix(code[5:], []byte{0x4d, 0x3b, 0x66, 0x10}):
+		cmp = 9
+	// LEAQ -disp32(SP), R12; CMPQ R12, 16(R14)
+	case bytes.HasPrefix(code, []byte{0x4c, 0x8d, 0xa4, 0x24}) && len(code) > 8 && bytes.HasPrefix(code[8:], []byte{0x4d, 0x3b, 0x66, 0x10}):
+		cmp = 12
+	default:
+		return 0, 0, 0, false
+	}
+	switch branch := code[cmp:]; {
+	// JBE rel32
+	case bytes.HasPrefix(branch, []byte{0x0f, 0x86}) && len(branch) >= 6:
+		jbe = 6
+		target = int64(cmp+jbe) + int64(int32(binary.LittleEndian.Uint32(branch[2:])))
+	// JBE rel8
+	case bytes.HasPrefix(branch, []byte{0x76}) && len(branch) >= 2:
+		jbe = 2
+		target = int64(cmp+jbe) + int64(int8(branch[1]))
+	default:
+		return 0, 0, 0, false
+	}
+	// at least rel32 jump has to fit into displaced stack check.
+	return cmp, jbe, target, cmp+jbe >= 5
+}
+
+// rel32 appends relative 32 bit jump with provided opcode
+// from provided code base address to provided target address.
+func rel32(code []byte, base, target uintptr, opcode ...byte) ([]byte, bool) {
+	code = append(code, opcode...)
+	rel := int64(target) - int64(base) - int64(len(code)+4)
+	if rel < math.MinInt32 || rel > math.MaxInt32 {
+		return nil, false
+	}
+	return append(code, byte(rel), byte(rel>>8), byte(rel>>16), byte(rel>>24)), true
+}
@@ -0,0 +1,84 @@
+//go:build go1.17 && (linux || darwin) && !race && !msan && !asan
+// +build go1.17
+// +build linux darwin
+// +build !race,!msan,!asan
+
+#include "textflag.h"
+#include "funcdata.h"
+
+// SLOT defines single 32 bytes stack check slot.
+#define SLOT \
+	BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; \
+	BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; \
+	BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; \
+	BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc; BYTE $0xcc
+
+// func mallocgcCheck()
+TEXT ·mallocgcCheck(SB), NOSPLIT|NOFRAME, $0-0
+	// slots for patched functions morestack branches, resume addresses
+	// and jumps to trampoline that are filled on patching.
+	SLOT; SLOT; SLOT; SLOT
+	SLOT; SLOT; SLOT; SLOT
+	SLOT; SLOT; SLOT; SLOT
+	SLOT; SLOT; SLOT; SLOT
+
+// func mallocgcTrampoline()
+TEXT ·mallocgcTrampoline(SB), NOSPLIT, $72-0
+	NO_LOCAL_POINTERS
+	// skip malloc tracing for system stack allocations
+	// as g0 isn't bound to any context, g.m.g0 == g.
+	MOVQ 48(R14), R13
+	CMPQ R14, 0(R13)
+	JEQ skip
+	// save patched function register arguments and resume address.
+	MOVQ AX, 40(SP)
+	MOVQ BX, 48(SP)
+	MOVQ CX, 56(SP)
+	MOVQ R12, 64(SP)
+	// call malloc tracing with stack arguments.
+	MOVQ AX, 0(SP)
+	MOVQ BX, 8(SP)
+	MOVB CX, 16(SP)
+	MOVQ R12, 24(SP)
+	CALL ·malloc(SB)
+	// return allocation made by malloc tracing if any
+	// instead of resuming original patched function.
+	XORPS X15, X15
+	MOVQ 32(SP), AX
+	TESTQ AX, AX
+	JNE done
+	// restore patched function register arguments and resume address.
+	MOVQ 40(SP), AX
+	MOVQ 48(SP), BX
+	MOVQ 56(SP), CX
+	MOVQ 64(SP), R12
+skip:
+	RET ·mallocgcTail(SB)
+done:
+	RET
+
+// func mallocgcTail()
+TEXT ·mallocgcTail(SB), NOSPLIT|NOFRAME, $0-0
+	JMP R12
+
+// func trampolines() (check, trampoline uintptr)
+TEXT ·trampolines(SB), NOSPLIT, $0-16
+	MOVQ $·mallocgcCheck(SB), AX
+	MOVQ AX, check+0(FP)
+	MOVQ $·mallocgcTrampoline(SB), AX
+	MOVQ AX, trampoline+8(FP)
+	RET
+
+// func store16(addr uintptr, lo, hi uint64)
+TEXT ·store16(SB), NOSPLIT, $0-24
+	MOVQ addr+0(FP), DI
+	MOVQ lo+8(FP), BX
+	MOVQ hi+16(FP), CX
+	MOVQ 0(DI), AX
+	MOVQ 8(DI), DX
+retry:
+	// on failure CMPXCHG16B loads current value into DX:AX.
+	LOCK
+	CMPXCHG16B (DI)
+	JNE retry
+	RET
@@ -0,0 +1,76 @@
+//go:build go1.17 && (linux || darwin) && !race && !msan && !asan
+// +build go1.17
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStackCheck(t *testing.T) {
+	table := map[string]struct {
+		code   []byte
+		cmp    int
+		jbe    int
+		target int64
+		ok     bool
+	}{
+		"small frame stack check with rel32 branch should be parsed": {
+			code:   []byte{0x49, 0x3b, 0x66, 0x10, 0x0f, 0x86, 0x8f, 0x01, 0x00, 0x00, 0x55},
+			cmp:    4,
+			jbe:    6,
+			target: 0x199,
+			ok:     true,
+		},
+		"medium frame stack check with rel8 branch should be parsed": {
+			code:   []byte{0x4c, 0x8d, 0x64, 0x24, 0xd8, 0x4d, 0x3b, 0x66, 0x10, 0x76, 0x40, 0x55},
+			cmp:    9,
+			jbe:    2,
+			target: 0x4b,
+			ok:     true,
+		},
+		"large frame stack check with rel32 branch should be parsed": {
+			code:   []byte{0x4c, 0x8d, 0xa4, 0x24, 0x00, 0xf0, 0xff, 0xff, 0x4d, 0x3b, 0x66, 0x10, 0x0f, 0x86, 0x00, 0x01, 0x00, 0x00},
+			cmp:    12,
+			jbe:    6,
+			target: 0x112,
+			ok:     true,
+		},
+		"small frame stack check with rel8 branch should be parsed": {
+			code:   []byte{0x49, 0x3b, 0x66, 0x10, 0x76, 0x40, 0x55},
+			cmp:    4,
+			jbe:    2,
+			target: 0x46,
+			ok:     true,
+		},
+		"truncated stack check branch should be rejected": {
+			code: []byte{0x49, 0x3b, 0x66, 0x10, 0x0f, 0x86, 0x8f},
+		},
+		"stack check without branch should be rejected": {
+			code: []byte{0x49, 0x3b, 0x66, 0x10, 0x55, 0x48, 0x89, 0xe5},
+		},
+		"unexpected prologue should be rejected": {
+			code: []byte{0x55, 0x48, 0x89, 0xe5, 0x48, 0x83, 0xec, 0x20},
+		},
+		"truncated prologue should be rejected": {
+			code: []byte{0x4c, 0x8d, 0x64, 0x24},
+		},
+	}
+	for tname, tcase := range table {
+		t.Run(tname, func(t *testing.T) {
+			cmp, jbe, target, ok := stackcheck(tcase.code)
+			require.Equal(t, tcase.ok, ok)
+			if ok {
+				require.Equal(t, tcase.cmp, cmp)
+				require.Equal(t, tcase.jbe, jbe)
+				require.Equal(t, tcase.target, target)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build go1.18 && (linux || darwin) && !race && !msan && !asan
+// +build go1.18
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+// mallocgcTrampoline calls malloc tracing with patched function register arguments
+// and tail jumps to mallocgcTail or returns allocation made by malloc tracing
+// directly to patched function caller if any, it's implemented in assembly.
+// Note that trampoline is not supposed to be called directly
+// as it's branched into from stack check slots.
+func mallocgcTrampoline()
@@ -0,0 +1,41 @@
+//go:build go1.18 && (linux || darwin) && !race && !msan && !asan
+// +build go1.18
+// +build linux darwin
+// +build !race,!msan,!asan
+
+#include "textflag.h"
+#include "funcdata.h"
+
+// func mallocgcTrampoline()
+TEXT ·mallocgcTrampoline(SB), NOSPLIT, $88-0
+	NO_LOCAL_POINTERS
+	// skip malloc tracing for system stack allocations
+	// as g0 isn't bound to any context, g.m.g0 == g.
+	MOVD 48(g), R16
+	MOVD 0(R16), R16
+	CMP g, R16
+	BEQ skip
+	// save patched function register arguments and resume address.
+	MOVD R0, 48(RSP)
+	MOVD R1, 56(RSP)
+	MOVD R2, 64(RSP)
+	MOVD R17, 72(RSP)
+	// call malloc tracing with stack arguments.
+	MOVD R0, 8(RSP)
+	MOVD R1, 16(RSP)
+	MOVB R2, 24(RSP)
+	MOVD R17, 32(RSP)
+	CALL ·malloc(SB)
+	// return allocation made by malloc tracing if any
+	// instead of resuming original patched function.
+	MOVD 40(RSP), R0
+	CBNZ R0, done
+	// restore patched function register arguments and resume address.
+	MOVD 48(RSP), R0
+	MOVD 56(RSP), R1
+	MOVD 64(RSP), R2
+	MOVD 72(RSP), R17
+skip:
+	RET ·mallocgcTail(SB)
+done:
+	RET
@@ -0,0 +1,33 @@
+//go:build goexperiment.sizespecializedmalloc && !race && !msan && !asan
+// +build goexperiment.sizespecializedmalloc,!race,!msan,!asan
+
+package gotcha
+
+// specialized defines whether toolchain size specialized malloc is enabled,
+// in which case compiler calls size specialized runtime allocation functions
+// for small objects directly bypassing mallocgc, so they are patched as well.
+const specialized = true
+
+// specializedMax defines max allocation size that mallocgc dispatches
+// to size specialized runtime allocation functions.
+const specializedMax = 80
+
+// specializedEntrypoints defines size specialized runtime allocation functions
+// that share mallocgc signature and that are called for small objects
+// either directly by compiler or by mallocgc dispatch.
+var specializedEntrypoints = []string{
+	"runtime.mallocgcTinySC2",
+	"runtime.mallocgcSmallNoScanSC2",
+	"runtime.mallocgcSmallNoScanSC3",
+	"runtime.mallocgcSmallNoScanSC4",
+	"runtime.mallocgcSmallNoScanSC5",
+	"runtime.mallocgcSmallNoScanSC6",
+	"runtime.mallocgcSmallNoScanSC7",
+	"runtime.mallocgcSmallScanNoHeaderSC1",
+	"runtime.mallocgcSmallScanNoHeaderSC2",
+	"runtime.mallocgcSmallScanNoHeaderSC3",
+	"runtime.mallocgcSmallScanNoHeaderSC4",
+	"runtime.mallocgcSmallScanNoHeaderSC5",
+	"runtime.mallocgcSmallScanNoHeaderSC6",
+	"runtime.mallocgcSmallScanNoHeaderSC7",
+}
@@ -0,0 +1,53 @@
+//go:build !go1.17 && (linux || darwin) && !race && !msan && !asan
+// +build !go1.17
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"runtime"
+	"unsafe"
+
+	"github.com/1pkg/gomonkey"
+)
+
+// patch patches mallocgc with permanent decorator
+// that calls malloc tracing before original mallocgc.
+// Note that decorator prologue relies on stack based calling convention
+// where mallocgc arguments are read from caller stack frame
+// and that decorator replaces mallocgc frame setup `sub rsp,0x98`.
+// Patch returns unpatch function that restores decorated code.
+func patch() (func() error, error) {
+	entry := reflect.ValueOf(mallocgc).Pointer()
+	if f := runtime.FuncForPC(entry); f == nil || f.Name() != "runtime.mallocgc" || f.Entry() != entry {
+		return nil, errors.New("gotcha: can't resolve runtime.mallocgc entry")
+	}
+	if !bytes.Equal(text(entry+24, 7), []byte{0x48, 0x81, 0xec, 0x98, 0x00, 0x00, 0x00}) {
+		return nil, errors.New("gotcha: unexpected runtime.mallocgc frame setup")
+	}
+	orig := append([]byte(nil), text(entry+24, 53)...)
+	gomonkey.PermanentDecorate(mallocgc, func(size uintptr, tp *tp, needzero bool) unsafe.Pointer {
+		// in use allocations are never tracked before go 1.24,
+		// so malloc tracing never returns its own allocation here.
+		_ = malloc(size, tp, needzero, 0)
+		return nil
+	}, 24, 53, []byte{
+		0x48, 0x83, 0xec, 0x28, // sub rsp,0x28
+		0x48, 0x8b, 0x44, 0x24, 0x30, // mov rax,QWORD PTR [rsp+0x30]
+		0x48, 0x89, 0x04, 0x24, // mov QWORD PTR [rsp],rax
+		0x48, 0x8b, 0x44, 0x24, 0x38, // mov rax,QWORD PTR [rsp+0x38]
+		0x48, 0x89, 0x44, 0x24, 0x08, // mov QWORD PTR [rsp],rax
+	}, []byte{
+		0x48, 0x83, 0xc4, 0x28, // add rsp,0x28
+		0x48, 0x81, 0xec, 0x98, 0x00, 0x00, 0x00, // sub rsp,0x98
+	})
+	return func() error {
+		return write(entry+24, orig)
+	}, nil
+}
@@ -0,0 +1,7 @@
+//go:build !go1.17 && (linux || darwin) && !race && !msan && !asan
+// +build !go1.17
+// +build linux darwin
+// +build !race,!msan,!asan
+
+// empty assembly file allows bodyless mallocgc linkname declaration
+// without cgo for stack based calling convention mallocgc patch.
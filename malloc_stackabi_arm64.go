@@ -0,0 +1,14 @@
+//go:build !go1.18 && (linux || darwin) && !race && !msan && !asan
+// +build !go1.18
+// +build linux darwin
+// +build !race
+// +build !msan
+// +build !asan
+
+package gotcha
+
+// mallocgcTrampoline calls malloc tracing with mallocgc stack arguments
+// and tail jumps to mallocgcTail, it's implemented in assembly.
+// Note that trampoline is not supposed to be called directly
+// as it's branched into from mallocgc stack check slot.
+func mallocgcTrampoline(size uintptr, tp *tp, needzero bool)
@@ -0,0 +1,31 @@
+//go:build !go1.18 && (linux || darwin) && !race && !msan && !asan
+// +build !go1.18
+// +build linux darwin
+// +build !race,!msan,!asan
+
+#include "textflag.h"
+
+// func mallocgcTrampoline(size uintptr, tp *tp, needzero bool)
+TEXT ·mallocgcTrampoline(SB), NOSPLIT, $56-17
+	// skip malloc tracing for system stack allocations
+	// as g0 isn't bound to any context, g.m.g0 == g.
+	MOVD 48(g), R16
+	MOVD 0(R16), R16
+	CMP g, R16
+	BEQ skip
+	// call malloc tracing with mallocgc stack arguments.
+	MOVD size+0(FP), R0
+	MOVD tp+8(FP), R1
+	MOVBU needzero+16(FP), R2
+	MOVD R0, 8(RSP)
+	MOVD R1, 16(RSP)
+	MOVB R2, 24(RSP)
+	MOVD R17, 32(RSP)
+	MOVD R17, 48(RSP)
+	// in use allocations are never tracked before go 1.24,
+	// so malloc tracing result is always nil and ignored.
+	CALL ·malloc(SB)
+	// restore patched function resume address.
+	MOVD 48(RSP), R17
+skip:
+	RET ·mallocgcTail(SB)
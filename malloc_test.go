@@ -2,19 +2,59 @@ package gotcha
 
 import (
 	"context"
+	"errors"
+	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
 
-// epsAlloc defines alloc error delta for test
-// as it's tough to carefully trace all possible small
-// underlying allocations - defining relative deviation buffer simplifies it
-const epsAlloc = 0.66
+func TestMain(m *testing.M) {
+	// malloc tracing isn't supported on every platform,
+	// tests depending on it are skipped then.
+	_ = Install()
+	os.Exit(m.Run())
+}
+
+// traceAlloc traces single allocation of provided size on provided context
+// panicking caller goroutine the same way malloc tracing does.
+func traceAlloc(ctx Context, size uintptr) {
+	if v := ctx.(*gotchactx).alloc(1, size, nil, 1); v != nil {
+		panic(v)
+	}
+}
+
+// installed skips test if malloc tracing isn't installed.
+// Note that degraded malloc tracing still traces mallocgc allocations.
+func installed(t *testing.T) {
+	if err := Status(); err != nil && !errors.Is(err, ErrDegraded) {
+		t.Skip(err)
+	}
+}
+
+// degrades returns true if size specialized malloc functions aren't patched
+// on toolchains with size specialized malloc.
+func degrades() bool {
+	return specialized && atomic.LoadInt32(&dispatched) == 0
+}
+
+// degraded checks that provided malloc tracing error is `ErrDegraded`
+// when small objects allocations aren't traced and nil otherwise.
+func degraded(t *testing.T, err error) {
+	if degrades() {
+		require.Equal(t, ErrDegraded, err)
+		return
+	}
+	require.NoError(t, err)
+}
 
 func TestTraceTypes(t *testing.T) {
+	installed(t)
 	t.Run("trace no object alloc", func(t *testing.T) {
 		Trace(context.Background(), func(ctx Context) {
 			for i := 0; i < 1000; i++ {
@@ -26,101 +66,6 @@ func TestTraceTypes(t *testing.T) {
 			require.Equal(t, int64(0), c)
 		})
 	})
-	t.Run("trace new object alloc", func(t *testing.T) {
-		type sobj struct {
-			a, b int64
-		}
-		Trace(context.Background(), func(ctx Context) {
-			var v *sobj
-			for i := 0; i < 1000; i++ {
-				v = new(sobj)
-			}
-			v.a = 0
-			v.b = 0
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(16000), b, epsAlloc)
-			require.InEpsilon(t, int64(1000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
-	t.Run("trace new object alloc &", func(t *testing.T) {
-		type sobj struct {
-			a, b int64
-		}
-		Trace(context.Background(), func(ctx Context) {
-			var v *sobj
-			for i := 0; i < 1000; i++ {
-				v = &sobj{a: 1, b: 1}
-			}
-			v.a = 0
-			v.b = 0
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(16000), b, epsAlloc)
-			require.InEpsilon(t, int64(1000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
-	t.Run("trace new object alloc reflect", func(t *testing.T) {
-		type sobj struct {
-			a, b int64
-		}
-		Trace(context.Background(), func(ctx Context) {
-			var v *sobj = &sobj{}
-			tp := reflect.ValueOf(*v).Type()
-			for i := 0; i < 100; i++ {
-				vref := reflect.New(tp)
-				v = vref.Interface().(*sobj)
-			}
-			v.a = 0
-			v.b = 0
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(1600), b, epsAlloc)
-			require.InEpsilon(t, int64(100), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(100))
-		})
-	})
-	t.Run("trace make slice alloc", func(t *testing.T) {
-		Trace(context.Background(), func(ctx Context) {
-			var v []int64
-			for i := 0; i < 1000; i++ {
-				v = make([]int64, 1, 10)
-			}
-			v[0] = 0
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(80000), b, epsAlloc)
-			require.InEpsilon(t, int64(10000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
-	t.Run("trace make slice copy alloc", func(t *testing.T) {
-		Trace(context.Background(), func(ctx Context) {
-			var v []int64
-			vc := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
-			for i := 0; i < 1000; i++ {
-				v = make([]int64, 10)
-				copy(v, vc)
-			}
-			v[0] = 0
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(80000), b, epsAlloc)
-			require.InEpsilon(t, int64(1000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
-	t.Run("trace make slice append alloc", func(t *testing.T) {
-		Trace(context.Background(), func(ctx Context) {
-			var v []int64
-			for i := 0; i < 1000; i++ {
-				v = make([]int64, 10)
-				v = append(v, 1)
-			}
-			v[0] = 0
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(160000), b, epsAlloc)
-			require.InEpsilon(t, int64(20000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(2000))
-		})
-	})
 	t.Run("trace make map alloc", func(t *testing.T) {
 		Trace(context.Background(), func(ctx Context) {
 			var v map[string]int32
@@ -147,48 +92,6 @@ func TestTraceTypes(t *testing.T) {
 			require.GreaterOrEqual(t, c, int64(100))
 		})
 	})
-	t.Run("trace string bytes alloc", func(t *testing.T) {
-		Trace(context.Background(), func(ctx Context) {
-			cs := "foo | | bar"
-			var v []byte
-			for i := 0; i < 1000; i++ {
-				v = []byte(cs)
-			}
-			_ = len(v)
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(22000), b, epsAlloc)
-			require.InEpsilon(t, int64(1000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
-	t.Run("trace string runes alloc", func(t *testing.T) {
-		Trace(context.Background(), func(ctx Context) {
-			cs := "foo | | bar"
-			var v []rune
-			for i := 0; i < 1000; i++ {
-				v = []rune(cs)
-			}
-			_ = len(v)
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(44000), b, epsAlloc)
-			require.InEpsilon(t, int64(1000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
-	t.Run("trace bytes string alloc", func(t *testing.T) {
-		Trace(context.Background(), func(ctx Context) {
-			cb := []byte("foo | | bar")
-			var v string
-			for i := 0; i < 1000; i++ {
-				v = string(cb)
-			}
-			_ = len(v)
-			b, o, c := ctx.Used()
-			require.InEpsilon(t, int64(22000), b, epsAlloc)
-			require.InEpsilon(t, int64(1000), o, epsAlloc)
-			require.GreaterOrEqual(t, c, int64(1000))
-		})
-	})
 	t.Run("trace new object alloc complex", func(t *testing.T) {
 		type cobj struct {
 			mp   map[string][]string
@@ -214,6 +117,7 @@ func TestTraceTypes(t *testing.T) {
 }
 
 func TestTraceHierarchy(t *testing.T) {
+	installed(t)
 	Trace(context.Background(), func(ctx Context) {
 		var v1, v2, v3 []int64
 		Trace(ctx, func(ctx Context) {
@@ -264,3 +168,473 @@ func TestTraceHierarchy(t *testing.T) {
 		require.GreaterOrEqual(t, c, int64(5))
 	})
 }
+
+func TestTraceRebind(t *testing.T) {
+	installed(t)
+	var buf []byte
+	var used int64
+	Trace(context.Background(), func(ctx Context) {
+		Trace(ctx, func(ctx Context) {})
+		Trace(ctx, func(ctx Context) {
+			Trace(ctx, func(ctx Context) {})
+		})
+		b, _, _ := ctx.Used()
+		buf = make([]byte, 64*KiB)
+		used, _, _ = ctx.Used()
+		used -= b
+	})
+	buf[0] = 0
+	require.GreaterOrEqual(t, used, int64(64*KiB))
+}
+
+func TestTraceGo(t *testing.T) {
+	installed(t)
+	Trace(context.Background(), func(ctx Context) {
+		var v1, v2 []int64
+		var b1, o1, c1 int64
+		var wg sync.WaitGroup
+		wg.Add(2)
+		Go(ctx, func(ctx Context) {
+			v1 = make([]int64, 5, 10)
+			b1, o1, c1 = ctx.Used()
+			wg.Done()
+		})
+		Go(ctx, func(ctx Context) {
+			v2 = make([]int64, 5, 20)
+			wg.Done()
+		})
+		wg.Wait()
+		v1[0] = 0
+		v2[0] = 0
+		require.GreaterOrEqual(t, b1, int64(80))
+		require.GreaterOrEqual(t, o1, int64(10))
+		require.GreaterOrEqual(t, c1, int64(1))
+		b, o, c := ctx.Used()
+		require.GreaterOrEqual(t, b, int64(240))
+		require.GreaterOrEqual(t, o, int64(30))
+		require.GreaterOrEqual(t, c, int64(2))
+	})
+}
+
+func TestTraceGoHardStop(t *testing.T) {
+	installed(t)
+	var done bool
+	err := Trace(context.Background(), func(ctx Context) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		Go(NewContext(ctx, ContextWithLimitObjects(5)), func(ctx Context) {
+			defer wg.Done()
+			traceAlloc(ctx, 8)
+			traceAlloc(ctx, 8)
+			done = true
+		})
+		wg.Wait()
+		// parent is still aborted by its own next allocation.
+		traceAlloc(ctx, 8)
+	}, ContextWithLimitObjects(1), ContextWithHardStop())
+	require.False(t, done)
+	var aborted *ContextAborted
+	require.True(t, errors.As(err, &aborted))
+	require.True(t, errors.Is(err, ErrLimitExceeded))
+}
+
+func TestTraceHardStop(t *testing.T) {
+	installed(t)
+	t.Run("trace hard stop aborts own context", func(t *testing.T) {
+		var done bool
+		err := Trace(context.Background(), func(ctx Context) {
+			traceAlloc(ctx, 8)
+			traceAlloc(ctx, 8)
+			done = true
+		}, ContextWithLimitObjects(1), ContextWithHardStop())
+		require.False(t, done)
+		var aborted *ContextAborted
+		require.True(t, errors.As(err, &aborted))
+		require.True(t, errors.Is(err, ErrLimitExceeded))
+		require.Equal(t, aborted.Context.Err(), errors.Unwrap(err))
+	})
+	t.Run("trace hard stop aborts parent context", func(t *testing.T) {
+		var cerr error
+		var done bool
+		err := Trace(context.Background(), func(ctx Context) {
+			cerr = Trace(ctx, func(ctx Context) {
+				traceAlloc(ctx, 8)
+				traceAlloc(ctx, 8)
+			}, ContextWithLimitObjects(5), ContextWithHardStop())
+			done = true
+		}, ContextWithLimitObjects(1), ContextWithHardStop())
+		require.NoError(t, cerr)
+		require.False(t, done)
+		require.True(t, errors.Is(err, ErrLimitExceeded))
+	})
+	t.Run("trace without hard stop is not aborted", func(t *testing.T) {
+		var done bool
+		err := Trace(context.Background(), func(ctx Context) {
+			traceAlloc(ctx, 8)
+			traceAlloc(ctx, 8)
+			done = true
+		}, ContextWithLimitObjects(1))
+		require.True(t, done)
+		degraded(t, err)
+	})
+	t.Run("trace hard stop aborts real allocations", func(t *testing.T) {
+		var n int
+		err := Trace(context.Background(), func(ctx Context) {
+			for ; n < 10; n++ {
+				sink = make([]byte, 4096)
+			}
+		}, ContextWithLimitBytes(8192), ContextWithHardStop())
+		require.Equal(t, 2, n)
+		require.True(t, errors.Is(err, ErrLimitExceeded))
+	})
+	t.Run("trace hard stop doesn't abort runtime code", func(t *testing.T) {
+		m := make(map[int]*int)
+		var writes int
+		err := Trace(context.Background(), func(ctx Context) {
+			for ; writes < 1<<16; writes++ {
+				m[writes] = nil
+			}
+			sink = make([]byte, 4096)
+			writes = 0
+		}, ContextWithLimitBytes(64*KiB), ContextWithHardStop())
+		require.True(t, errors.Is(err, ErrLimitExceeded))
+		require.Equal(t, 1<<16, writes)
+		// map has to be left consistent and writable.
+		for i := 0; i < 1<<16; i++ {
+			m[-i] = nil
+		}
+		require.Len(t, m, 1<<17-1)
+	})
+	t.Run("trace hard stop keeps other panics", func(t *testing.T) {
+		require.PanicsWithValue(t, "panic", func() {
+			_ = Trace(context.Background(), func(ctx Context) {
+				panic("panic")
+			}, ContextWithHardStop())
+		})
+	})
+}
+
+func TestTracePolicyPanic(t *testing.T) {
+	installed(t)
+	var n int
+	require.PanicsWithError(t, "context limits have been exceeded on bytes 12288 of 8192 \"on this context: 12288 objects has been allocated with total size of 12288 bytes within 3 calls\"", func() {
+		_ = Trace(context.Background(), func(ctx Context) {
+			for ; n < 10; n++ {
+				sink = make([]byte, 4096)
+			}
+		}, ContextWithLimitBytes(8192), ContextWithPolicyPanic())
+	})
+	require.Equal(t, 2, n)
+}
+
+func TestTraceOnTraced(t *testing.T) {
+	installed(t)
+	var calls int
+	var tctx Context
+	var terr error
+	onTraced := func(ctx Context, err error) {
+		calls++
+		tctx, terr = ctx, err
+	}
+	err := Trace(context.Background(), func(ctx Context) {
+		traceAlloc(ctx, 8)
+		traceAlloc(ctx, 8)
+	}, ContextWithName("aborted"), ContextWithLimitObjects(1), ContextWithHardStop(), ContextWithOnTraced(onTraced))
+	require.Equal(t, 1, calls)
+	require.Equal(t, "aborted", tctx.Name())
+	require.Equal(t, err, terr)
+	require.True(t, errors.Is(terr, ErrLimitExceeded))
+	err = Trace(context.Background(), func(ctx Context) {
+		traceAlloc(ctx, 8)
+	}, ContextWithOnTraced(onTraced))
+	degraded(t, err)
+	require.Equal(t, 2, calls)
+	require.NoError(t, terr)
+	b, o, c := tctx.Used()
+	require.Equal(t, int64(8), b)
+	require.Equal(t, int64(1), o)
+	require.Equal(t, int64(1), c)
+	err = Trace(context.Background(), func(ctx Context) {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			Go(ctx, func(ctx Context) {
+				defer wg.Done()
+				traceAlloc(ctx, 8)
+			})
+		}
+		wg.Wait()
+		require.Equal(t, 2, calls)
+	}, ContextWithOnTraced(onTraced))
+	degraded(t, err)
+	require.Equal(t, 3, calls)
+	// traced usage also contains spawned goroutines allocations.
+	_, o, _ = tctx.Used()
+	require.GreaterOrEqual(t, o, int64(2))
+}
+
+func TestTraceSampling(t *testing.T) {
+	defer SetSampleRate(1)
+	require.Equal(t, int64(1), SampleRate())
+	require.Equal(t, int64(1), sample())
+	SetSampleRate(4)
+	require.Equal(t, int64(4), SampleRate())
+	var total, count int64
+	for i := 0; i < 100000; i++ {
+		if w := sample(); w != 0 {
+			require.Equal(t, int64(4), w)
+			total += w
+			count++
+		}
+	}
+	require.InDelta(t, 25000, count, 1000)
+	require.InDelta(t, 100000, total, 4000)
+	// periodic allocation pattern with the sampling rate period
+	// is still estimated without bias.
+	SetSampleRate(2)
+	var bytes int64
+	for i := 0; i < 100000; i++ {
+		size := int64(8)
+		if i%2 == 1 {
+			size = 1024
+		}
+		bytes += size * sample()
+	}
+	require.InEpsilon(t, 50000*(8+1024), bytes, 0.05)
+	SetSampleRate(4)
+	Trace(context.Background(), func(ctx Context) {
+		type sobj struct {
+			a, b int64
+		}
+		var v interface{} = sobj{}
+		ctx.(*gotchactx).alloc(1, 64, (*eface)(unsafe.Pointer(&v)).tp, 4)
+		b, o, c := ctx.Used()
+		require.Equal(t, int64(256), b)
+		require.Equal(t, int64(16), o)
+		require.Equal(t, int64(4), c)
+		require.Contains(t, ctx.String(), "estimated with 1/4 sampling rate")
+	}, ContextWithHistogram())
+	SetSampleRate(0)
+	require.Equal(t, int64(1), SampleRate())
+}
+
+// sink defines escaping allocations destination.
+var sink []byte
+
+// osink defines escaping objects destination.
+var osink interface{}
+
+func TestInstall(t *testing.T) {
+	installed(t)
+	trace := func() (int64, error) {
+		var bytes int64
+		err := Trace(context.Background(), func(ctx Context) {
+			sink = make([]byte, 1024)
+			bytes, _, _ = ctx.Used()
+		})
+		return bytes, err
+	}
+	degraded(t, Install())
+	require.Equal(t, !degrades(), Enabled())
+	degraded(t, Status())
+	bytes, err := trace()
+	degraded(t, err)
+	require.GreaterOrEqual(t, bytes, int64(1024))
+	require.NoError(t, Uninstall())
+	require.NoError(t, Uninstall())
+	require.False(t, Enabled())
+	require.True(t, errors.Is(Status(), ErrNotInstalled))
+	// goroutine local store isn't touched without malloc tracing.
+	require.Nil(t, bind(NewContext(context.Background()).(*gotchactx)))
+	require.Nil(t, guard())
+	bytes, err = trace()
+	require.True(t, errors.Is(err, ErrNotInstalled))
+	require.Equal(t, int64(0), bytes)
+	degraded(t, Install())
+	degraded(t, Install())
+	require.Equal(t, !degrades(), Enabled())
+	bytes, err = trace()
+	degraded(t, err)
+	require.GreaterOrEqual(t, bytes, int64(1024))
+}
+
+func TestTraceSpecialized(t *testing.T) {
+	installed(t)
+	if degrades() {
+		t.Skip("small objects allocations bypass mallocgc with size specialized malloc")
+	}
+	type tiny struct {
+		a int32
+	}
+	type noscan struct {
+		a, b, c, d int64
+	}
+	type scan struct {
+		a, b *int64
+		c    [4]int64
+	}
+	table := map[string]func(){
+		"tiny objects allocations should be traced once": func() {
+			for i := 0; i < 1000; i++ {
+				osink = new(tiny)
+			}
+		},
+		"small noscan objects allocations should be traced once": func() {
+			for i := 0; i < 1000; i++ {
+				osink = new(noscan)
+			}
+		},
+		"small scan objects allocations should be traced once": func() {
+			for i := 0; i < 1000; i++ {
+				osink = new(scan)
+			}
+		},
+		"small objects allocations dispatched by mallocgc should be traced once": func() {
+			for i := 0; i < 1000; i++ {
+				osink = reflect.New(reflect.TypeOf(noscan{})).Interface()
+			}
+		},
+	}
+	for tname, alloc := range table {
+		t.Run(tname, func(t *testing.T) {
+			Trace(context.Background(), func(ctx Context) {
+				alloc()
+				_, o, _ := ctx.Used()
+				require.GreaterOrEqual(t, o, int64(1000))
+				require.Less(t, o, int64(1100))
+			})
+		})
+	}
+}
+
+func TestTraceBookkeeping(t *testing.T) {
+	installed(t)
+	for name, opts := range map[string][]ContextOpt{
+		"plain":                nil,
+		"call sites":           {ContextWithCallSites(8)},
+		"types":                {ContextWithTypes()},
+		"call sites and types": {ContextWithCallSites(8), ContextWithTypes()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var gctx Context
+			_ = Trace(context.Background(), func(ctx Context) {
+				for i := 0; i < 10; i++ {
+					sink = make([]byte, 4096)
+				}
+				gctx = ctx
+			}, opts...)
+			b, o, c := gctx.Used()
+			require.Equal(t, int64(40960), b)
+			require.Equal(t, int64(40960), o)
+			require.Equal(t, int64(10), c)
+			// own types tracing allocations are not listed either.
+			if types := gctx.Types(0); types != nil {
+				require.Len(t, types, 1)
+				require.Equal(t, "uint8", types[0].Name)
+				require.Equal(t, int64(40960), types[0].Bytes)
+			}
+		})
+	}
+	t.Run("manual usage exceeding limits", func(t *testing.T) {
+		var gctx Context
+		_ = Trace(context.Background(), func(ctx Context) {
+			ctx.Add(101, 1, 1)
+			_ = ctx.Done()
+			_ = ctx.Err()
+			gctx = ctx
+		}, ContextWithLimitBytes(100), ContextWithCallSites(8))
+		b, o, c := gctx.Used()
+		require.Equal(t, int64(101), b)
+		require.Equal(t, int64(1), o)
+		require.Equal(t, int64(1), c)
+		require.Empty(t, gctx.CallSites(0))
+	})
+}
+
+func TestTraceSoftLimits(t *testing.T) {
+	installed(t)
+	var errs []error
+	_ = Trace(context.Background(), func(ctx Context) {
+		for i := 0; i < 10; i++ {
+			sink = make([]byte, 4096)
+		}
+		require.True(t, ctx.SoftExceeded())
+		require.False(t, ctx.Exceeded())
+	}, ContextWithSoftLimitBytes(8192), ContextWithOnSoftExceeded(func(ctx Context, err error) {
+		errs = append(errs, err)
+	}))
+	require.Len(t, errs, 1)
+	require.True(t, errors.Is(errs[0], ErrSoftLimitExceeded))
+	var lerr ContextLimitsExceeded
+	require.True(t, errors.As(errs[0], &lerr))
+	require.Equal(t, DimensionBytes, lerr.Dimensions)
+	require.Equal(t, int64(12288), lerr.Bytes)
+}
+
+func TestTraceThrottle(t *testing.T) {
+	installed(t)
+	var done bool
+	_ = Trace(context.Background(), func(ctx Context) {
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			sink = make([]byte, 4096)
+		}
+		require.Less(t, int64(time.Since(start)), int64(5*time.Millisecond))
+		// every allocation after limits are exceeded is throttled.
+		for i := 0; i < 8; i++ {
+			sink = make([]byte, 4096)
+		}
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(8*5*time.Millisecond))
+		start = time.Now()
+		require.True(t, errors.Is(ctx.Err(), ErrLimitExceeded))
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(5*time.Millisecond))
+		done = true
+	}, ContextWithLimitBytes(8192), ContextWithPolicyThrottle(5*time.Millisecond))
+	require.True(t, done)
+}
+
+func TestInstallInstrumented(t *testing.T) {
+	if !instrumented {
+		t.Skip("test requires race, msan or asan instrumented build")
+	}
+	err := Install()
+	require.True(t, errors.Is(err, ErrNotInstalled))
+	require.Contains(t, err.Error(), "race, msan or asan instrumented builds")
+	require.Equal(t, err, Status())
+	require.False(t, Enabled())
+	// traces keep working with manually added usage.
+	err = Trace(context.Background(), func(ctx Context) {
+		ctx.Add(8, 1, 1)
+		b, o, c := ctx.Used()
+		require.Equal(t, int64(8), b)
+		require.Equal(t, int64(1), o)
+		require.Equal(t, int64(1), c)
+	})
+	require.True(t, errors.Is(err, ErrNotInstalled))
+}
+
+func TestInstallConcurrent(t *testing.T) {
+	installed(t)
+	defer func() {
+		_ = Install()
+	}()
+	var stop int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				_ = Trace(context.Background(), func(ctx Context) {
+					sink = make([]byte, 64)
+				})
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, Uninstall())
+		_ = Install()
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
@@ -1,6 +1,10 @@
 package gotcha
 
-import "sync/atomic"
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
 
 // units definition coppied from https://github.com/alecthomas/units
 
@@ -71,3 +75,226 @@ func ContextWithLimitCalls(lcalls int64) ContextOpt {
 		atomic.StoreInt64(&ctx.lcalls, lcalls)
 	}
 }
+
+// ContextWithName defines gotcha context name option.
+func ContextWithName(name string) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.name = name
+	}
+}
+
+// ContextWithLabels defines gotcha context labels option.
+// Note that provided labels are copied and merged with existing context labels.
+func ContextWithLabels(labels map[string]string) ContextOpt {
+	return func(ctx *gotchactx) {
+		if ctx.labels == nil {
+			ctx.labels = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			ctx.labels[k] = v
+		}
+	}
+}
+
+// ContextWithRateLimitBytes defines allocation rate limit bytes gotcha context option
+// that limits bytes allocated within provided sliding time window.
+func ContextWithRateLimitBytes(lbytes int64, window time.Duration) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.rtbytes = nil
+		if lbytes > Infinity {
+			ctx.rtbytes = newRate(lbytes, window)
+		}
+	}
+}
+
+// ContextWithRateLimitObjects defines allocation rate limit objects gotcha context option
+// that limits objects allocated within provided sliding time window.
+func ContextWithRateLimitObjects(lobjects int64, window time.Duration) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.rtobjects = nil
+		if lobjects > Infinity {
+			ctx.rtobjects = newRate(lobjects, window)
+		}
+	}
+}
+
+// ContextWithRateLimitCalls defines allocation rate limit calls gotcha context option
+// that limits allocation calls made within provided sliding time window.
+func ContextWithRateLimitCalls(lcalls int64, window time.Duration) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.rtcalls = nil
+		if lcalls > Infinity {
+			ctx.rtcalls = newRate(lcalls, window)
+		}
+	}
+}
+
+// ContextWithSoftLimitBytes defines allocation soft limit bytes gotcha context option.
+func ContextWithSoftLimitBytes(sbytes int64) ContextOpt {
+	return func(ctx *gotchactx) {
+		atomic.StoreInt64(&ctx.sbytes, sbytes)
+	}
+}
+
+// ContextWithSoftLimitObjects defines allocation soft limit objects gotcha context option.
+func ContextWithSoftLimitObjects(sobjects int64) ContextOpt {
+	return func(ctx *gotchactx) {
+		atomic.StoreInt64(&ctx.sobjects, sobjects)
+	}
+}
+
+// ContextWithSoftLimitCalls defines allocation soft limit calls gotcha context option.
+func ContextWithSoftLimitCalls(scalls int64) ContextOpt {
+	return func(ctx *gotchactx) {
+		atomic.StoreInt64(&ctx.scalls, scalls)
+	}
+}
+
+// ContextWithSoftLimitPercent defines allocation soft limits gotcha context option
+// as provided percent of hard limits for all soft limits that are not set explicitly.
+func ContextWithSoftLimitPercent(percent int64) ContextOpt {
+	return func(ctx *gotchactx) {
+		atomic.StoreInt64(&ctx.spercent, percent)
+	}
+}
+
+// ContextWithOnSoftExceeded defines context soft limits exceeded hook gotcha context option
+// that is called exactly once from allocating goroutine
+// at the moment context soft limits are exceeded.
+// Note that soft limits exceeding doesn't make context exceeded.
+func ContextWithOnSoftExceeded(f func(Context, error)) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.onsoftexceeded = append(ctx.onsoftexceeded, f)
+	}
+}
+
+// ContextWithCallSites defines allocation call sites tracing gotcha context option
+// that captures provided depth of allocation callers frames.
+// Note that call sites tracing is expensive and disabled by default.
+func ContextWithCallSites(depth int) ContextOpt {
+	return func(ctx *gotchactx) {
+		if depth > 0 {
+			ctx.sites = newCallSites(depth)
+		}
+	}
+}
+
+// ContextWithInUseSampling defines in use memory estimation gotcha context option
+// that tracks sampled allocations of the context and its derived contexts
+// until they are freed and estimates context in use memory by subtracting
+// freed allocations from the context usage, see `SetInUseSampleRate`.
+// Note that only allocations made by user code are tracked with runtime cleanups
+// that require go 1.24, otherwise in use estimation matches the context usage.
+// Note that freed allocations are only observed after gc cycles.
+func ContextWithInUseSampling() ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.inuse = true
+	}
+}
+
+// ContextWithTypes defines allocation types tracing gotcha context option
+// that groups allocations by their types.
+// Note that types tracing is disabled by default.
+func ContextWithTypes() ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.types = newTypeAllocs()
+	}
+}
+
+// ContextWithHistogram defines allocation size histogram gotcha context option
+// that groups allocations by go runtime size classes.
+// Note that size histogram is disabled by default.
+func ContextWithHistogram() ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.hist = &histogram{}
+	}
+}
+
+// ContextWithOnExceeded defines context limits exceeded hook gotcha context option
+// that is called exactly once from allocating goroutine
+// at the moment context limits are exceeded.
+// Note that multiple hooks are called in the order they were provided.
+func ContextWithOnExceeded(f func(Context, error)) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.onexceeded = append(ctx.onexceeded, f)
+	}
+}
+
+// ContextWithOnTraced defines trace completion hook gotcha context option
+// that is called once `Trace` call that created the context returns
+// with trace result error, which is non nil only for hard stop aborts.
+// Note that hook is never called for goroutines spawned with `Go`
+// and allocations made inside the hook are not traced by the context.
+func ContextWithOnTraced(f func(Context, error)) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.ontraced = append(ctx.ontraced, f)
+	}
+}
+
+// ContextWithPolicyCancel defines cancel only limits enforcement policy gotcha context option
+// that only cancels context once context limits are exceeded which is default policy.
+func ContextWithPolicyCancel() ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.policy = nil
+		ctx.panics = false
+		ctx.throttle = 0
+	}
+}
+
+// ContextWithPolicyLog defines log limits enforcement policy gotcha context option
+// that additionally logs limits exceeded error with provided logger
+// once context limits are exceeded.
+func ContextWithPolicyLog(l *log.Logger) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.policy = func(_ Context, err error) {
+			l.Println(err)
+		}
+		ctx.panics = false
+		ctx.throttle = 0
+	}
+}
+
+// ContextWithPolicyPanic defines panic limits enforcement policy gotcha context option
+// that additionally panics allocating goroutine with limits exceeded error
+// once context limits are exceeded.
+// Note that traced allocations made by go runtime code on behalf of the goroutine,
+// for example by map assignments, never panic as it could leave runtime structures corrupted,
+// so the panic is postponed until the next allocation made by user code.
+// Nevertheless any objects that are being mutated at the moment of panic
+// should be discarded by the goroutine that recovers the panic.
+func ContextWithPolicyPanic() ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.policy = nil
+		ctx.panics = true
+		ctx.throttle = 0
+	}
+}
+
+// ContextWithPolicyThrottle defines throttle limits enforcement policy gotcha context option
+// that additionally puts goroutine to sleep for provided duration
+// on every traced allocation and every context done or err check
+// made after context limits are exceeded, so traced goroutines are slowed down.
+// Note that traced allocations made by go runtime code on behalf of the goroutine,
+// for example map growth, are never throttled as sleeping inside go runtime code isn't safe.
+func ContextWithPolicyThrottle(d time.Duration) ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.policy = nil
+		ctx.panics = false
+		ctx.throttle = d
+	}
+}
+
+// ContextWithHardStop defines hard stop gotcha context option
+// that aborts traced goroutine with panic at the allocation
+// that exceeded context limits, the panic is then recovered by
+// the context trace function and returned as context aborted error.
+// Note that traced allocations made by go runtime code on behalf of the goroutine,
+// for example by map assignments, are never aborted as it could leave runtime
+// structures corrupted, so the abort is postponed until the next allocation made by user code.
+// Nevertheless any objects that are being mutated by the goroutine at the moment of abort
+// should be discarded after the trace is aborted.
+func ContextWithHardStop() ContextOpt {
+	return func(ctx *gotchactx) {
+		ctx.abort = &ContextAborted{Context: ctx}
+	}
+}
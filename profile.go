@@ -0,0 +1,206 @@
+package gotcha
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// ErrCallSitesDisabled defines error that is returned
+// on call sites dependent actions if call sites tracking is disabled.
+var ErrCallSitesDisabled = errors.New("context call sites tracking is disabled")
+
+// profile defines pprof `profile.proto` compatible profile builder
+// that converts call sites into alloc_objects and alloc_space samples.
+// See https://github.com/google/pprof/blob/master/proto/profile.proto
+type profile struct {
+	strings   []string
+	sindexes  map[string]int64
+	locations map[uintptr]uint64
+	functions map[[2]string]uint64
+	pb        protobuf
+}
+
+func newProfile() *profile {
+	return &profile{
+		strings:   []string{""},
+		sindexes:  map[string]int64{"": 0},
+		locations: make(map[uintptr]uint64),
+		functions: make(map[[2]string]uint64),
+	}
+}
+
+// write builds profile from provided call sites and labels
+// and writes it gzip compressed to provided writer.
+func (p *profile) write(w io.Writer, sites []CallSite, labels map[string]string, t time.Time) error {
+	p.valueType(1, "alloc_objects", "count")
+	p.valueType(1, "alloc_space", "bytes")
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, site := range sites {
+		ids := make([]uint64, 0, len(site.Stack))
+		for _, pc := range site.Stack {
+			ids = append(ids, p.location(pc))
+		}
+		p.pb.message(2, func(pb *protobuf) {
+			pb.uint64s(1, ids)
+			pb.uint64s(2, []uint64{uint64(site.Objects), uint64(site.Bytes)})
+			for _, k := range keys {
+				key, val := p.string(k), p.string(labels[k])
+				pb.message(3, func(pb *protobuf) {
+					pb.int64(1, key)
+					pb.int64(2, val)
+				})
+			}
+		})
+	}
+	p.pb.int64(9, t.UnixNano())
+	p.valueType(11, "space", "bytes")
+	p.pb.int64(12, 1)
+	// string table has to be written last
+	// as it's filled up by all other messages.
+	for _, s := range p.strings {
+		p.pb.string(6, s)
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(p.pb.buf); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// string returns provided string index in profile string table.
+func (p *profile) string(s string) int64 {
+	if i, ok := p.sindexes[s]; ok {
+		return i
+	}
+	i := int64(len(p.strings))
+	p.strings = append(p.strings, s)
+	p.sindexes[s] = i
+	return i
+}
+
+// valueType writes value type message for provided field.
+func (p *profile) valueType(field int, tp, unit string) {
+	tpi, uniti := p.string(tp), p.string(unit)
+	p.pb.message(field, func(pb *protobuf) {
+		pb.int64(1, tpi)
+		pb.int64(2, uniti)
+	})
+}
+
+// location returns provided pc location id
+// writing location message with inlined lines if needed.
+func (p *profile) location(pc uintptr) uint64 {
+	if id, ok := p.locations[pc]; ok {
+		return id
+	}
+	id := uint64(len(p.locations) + 1)
+	p.locations[pc] = id
+	type line struct {
+		function uint64
+		line     int64
+	}
+	var lines []line
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := frames.Next()
+		lines = append(lines, line{function: p.function(frame.Function, frame.File), line: int64(frame.Line)})
+		if !more {
+			break
+		}
+	}
+	p.pb.message(4, func(pb *protobuf) {
+		pb.uint64(1, id)
+		pb.uint64(3, uint64(pc))
+		for _, l := range lines {
+			pb.message(4, func(pb *protobuf) {
+				pb.uint64(1, l.function)
+				pb.int64(2, l.line)
+			})
+		}
+	})
+	return id
+}
+
+// function returns provided function id
+// writing function message if needed.
+func (p *profile) function(name, file string) uint64 {
+	key := [2]string{name, file}
+	if id, ok := p.functions[key]; ok {
+		return id
+	}
+	id := uint64(len(p.functions) + 1)
+	p.functions[key] = id
+	namei, filei := p.string(name), p.string(file)
+	p.pb.message(5, func(pb *protobuf) {
+		pb.uint64(1, id)
+		pb.int64(2, namei)
+		pb.int64(3, namei)
+		pb.int64(4, filei)
+	})
+	return id
+}
+
+// protobuf defines minimal protocol buffers wire format encoder.
+type protobuf struct {
+	buf []byte
+}
+
+func (pb *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		pb.buf = append(pb.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	pb.buf = append(pb.buf, byte(x))
+}
+
+func (pb *protobuf) key(field int, wire uint64) {
+	pb.varint(uint64(field)<<3 | wire)
+}
+
+func (pb *protobuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	pb.key(field, 0)
+	pb.varint(x)
+}
+
+func (pb *protobuf) int64(field int, x int64) {
+	pb.uint64(field, uint64(x))
+}
+
+// uint64s writes provided values as packed repeated field.
+func (pb *protobuf) uint64s(field int, xs []uint64) {
+	var packed protobuf
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	pb.bytes(field, packed.buf)
+}
+
+func (pb *protobuf) string(field int, s string) {
+	pb.key(field, 2)
+	pb.varint(uint64(len(s)))
+	pb.buf = append(pb.buf, s...)
+}
+
+func (pb *protobuf) bytes(field int, b []byte) {
+	pb.key(field, 2)
+	pb.varint(uint64(len(b)))
+	pb.buf = append(pb.buf, b...)
+}
+
+// message writes nested message encoded by provided function.
+func (pb *protobuf) message(field int, f func(*protobuf)) {
+	var msg protobuf
+	f(&msg)
+	pb.bytes(field, msg.buf)
+}
@@ -0,0 +1,230 @@
+// Package prom provides dependency free prometheus text exposition
+// exporter for gotcha traced contexts usage and limits exceeding.
+package prom
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/1pkg/gotcha"
+)
+
+// bytesBuckets defines per trace bytes histogram buckets
+// from 64 bytes up to 1 gibibyte growing by factor of 4.
+var bytesBuckets = []float64{
+	64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+	1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30,
+}
+
+// countBuckets defines per trace objects and calls histogram buckets.
+var countBuckets = []float64{
+	1, 4, 16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576,
+}
+
+// dimensions defines exported limit dimensions in exposition order.
+var dimensions = []gotcha.Dimension{
+	gotcha.DimensionBytes,
+	gotcha.DimensionObjects,
+	gotcha.DimensionCalls,
+}
+
+// histogram defines cumulative prometheus histogram.
+type histogram struct {
+	buckets []float64
+	counts  []int64
+	sum     float64
+	count   int64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics defines single named context metrics.
+type metrics struct {
+	traces                   int64
+	bytes, objects, calls    int64
+	hbytes, hobjects, hcalls histogram
+	exceeded                 map[gotcha.Dimension]int64
+	softexceeded             int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		hbytes:   newHistogram(bytesBuckets),
+		hobjects: newHistogram(countBuckets),
+		hcalls:   newHistogram(countBuckets),
+		exceeded: make(map[gotcha.Dimension]int64, len(dimensions)),
+	}
+}
+
+// Collector defines gotcha contexts metrics collector
+// that aggregates contexts usage by context name on each trace completion
+// and exposes it in prometheus text exposition format.
+// Note that context is observed once its `Trace` call completes,
+// so goroutines spawned with `gotcha.Go` are rolled up into single observation.
+type Collector struct {
+	mu      sync.Mutex
+	metrics map[string]*metrics
+}
+
+// NewCollector creates new empty collector instance.
+func NewCollector() *Collector {
+	return &Collector{metrics: make(map[string]*metrics)}
+}
+
+// Option returns gotcha context option
+// that observes context once its trace completes.
+func (c *Collector) Option() gotcha.ContextOpt {
+	return gotcha.ContextWithOnTraced(func(ctx gotcha.Context, err error) {
+		c.Observe(ctx)
+	})
+}
+
+// Observe records provided context usage, limits and soft limits exceeding
+// into the collector under the context name.
+// Note that observe shouldn't be called from traced tracer functions
+// as own observe allocations could exceed the context and affect its usage.
+func (c *Collector) Observe(ctx gotcha.Context) {
+	bytes, objects, calls := ctx.Used()
+	var dims gotcha.Dimension
+	var lerr gotcha.ContextLimitsExceeded
+	if errors.As(ctx.Err(), &lerr) {
+		dims = lerr.Dimensions
+	}
+	soft := ctx.SoftExceeded()
+	name := ctx.Name()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.metrics[name]
+	if !ok {
+		m = newMetrics()
+		c.metrics[name] = m
+	}
+	m.traces++
+	m.bytes += bytes
+	m.objects += objects
+	m.calls += calls
+	m.hbytes.observe(float64(bytes))
+	m.hobjects.observe(float64(objects))
+	m.hcalls.observe(float64(calls))
+	for _, dim := range dimensions {
+		if dims&dim != 0 {
+			m.exceeded[dim]++
+		}
+	}
+	if soft {
+		m.softexceeded++
+	}
+}
+
+// WriteTo writes all collected metrics
+// in prometheus text exposition format to provided writer.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	names := make([]string, 0, len(c.metrics))
+	snapshots := make([]metrics, 0, len(c.metrics))
+	for name := range c.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := *c.metrics[name]
+		m.hbytes.counts = append([]int64(nil), m.hbytes.counts...)
+		m.hobjects.counts = append([]int64(nil), m.hobjects.counts...)
+		m.hcalls.counts = append([]int64(nil), m.hcalls.counts...)
+		exceeded := make(map[gotcha.Dimension]int64, len(m.exceeded))
+		for dim, n := range m.exceeded {
+			exceeded[dim] = n
+		}
+		m.exceeded = exceeded
+		snapshots = append(snapshots, m)
+	}
+	c.mu.Unlock()
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	write := func(metric, tp, help string, f func(name string, m *metrics)) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", metric, help, metric, tp)
+		for i := range snapshots {
+			f(label(names[i]), &snapshots[i])
+		}
+	}
+	counter := func(metric, help string, value func(m *metrics) int64) {
+		write(metric, "counter", help, func(name string, m *metrics) {
+			fmt.Fprintf(bw, "%s{context=%s} %d\n", metric, name, value(m))
+		})
+	}
+	hist := func(metric, help string, value func(m *metrics) *histogram) {
+		write(metric, "histogram", help, func(name string, m *metrics) {
+			h := value(m)
+			for i, b := range h.buckets {
+				fmt.Fprintf(bw, "%s_bucket{context=%s,le=%q} %d\n", metric, name, float(b), h.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket{context=%s,le=\"+Inf\"} %d\n", metric, name, h.count)
+			fmt.Fprintf(bw, "%s_sum{context=%s} %s\n", metric, name, float(h.sum))
+			fmt.Fprintf(bw, "%s_count{context=%s} %d\n", metric, name, h.count)
+		})
+	}
+	counter("gotcha_traces_total", "Total number of completed traces.", func(m *metrics) int64 { return m.traces })
+	counter("gotcha_bytes_total", "Total number of traced allocated bytes.", func(m *metrics) int64 { return m.bytes })
+	counter("gotcha_objects_total", "Total number of traced allocated objects.", func(m *metrics) int64 { return m.objects })
+	counter("gotcha_calls_total", "Total number of traced allocation calls.", func(m *metrics) int64 { return m.calls })
+	hist("gotcha_trace_bytes", "Traced allocated bytes per trace.", func(m *metrics) *histogram { return &m.hbytes })
+	hist("gotcha_trace_objects", "Traced allocated objects per trace.", func(m *metrics) *histogram { return &m.hobjects })
+	hist("gotcha_trace_calls", "Traced allocation calls per trace.", func(m *metrics) *histogram { return &m.hcalls })
+	write("gotcha_limit_exceeded_total", "counter", "Total number of traces that exceeded context limits by dimension.", func(name string, m *metrics) {
+		for _, dim := range dimensions {
+			fmt.Fprintf(bw, "gotcha_limit_exceeded_total{context=%s,dimension=%q} %d\n", name, dim.String(), m.exceeded[dim])
+		}
+	})
+	counter("gotcha_soft_limit_exceeded_total", "Total number of traces that exceeded context soft limits.", func(m *metrics) int64 { return m.softexceeded })
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves all collected metrics
+// in prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+// countWriter defines writer wrapper that counts written bytes.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// label returns quoted and escaped prometheus label value.
+func label(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
+
+// float returns prometheus float value representation.
+func float(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
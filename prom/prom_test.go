@@ -0,0 +1,70 @@
+package prom
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1pkg/gotcha"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	t.Run("collector exposes named contexts metrics", func(t *testing.T) {
+		c := NewCollector()
+		ctx := gotcha.NewContext(
+			context.Background(),
+			gotcha.ContextWithName("handler"),
+			gotcha.ContextWithLimitObjects(10),
+			gotcha.ContextWithSoftLimitCalls(1),
+		)
+		ctx.Add(100, 20, 2)
+		c.Observe(ctx)
+		ctx = gotcha.NewContext(context.Background(), gotcha.ContextWithName("handler"))
+		ctx.Add(8, 1, 1)
+		c.Observe(ctx)
+		ctx = gotcha.NewContext(context.Background(), gotcha.ContextWithName(`db "query"`))
+		c.Observe(ctx)
+		var buf bytes.Buffer
+		n, err := c.WriteTo(&buf)
+		require.NoError(t, err)
+		require.Equal(t, int64(buf.Len()), n)
+		out := buf.String()
+		for _, line := range []string{
+			"# HELP gotcha_traces_total Total number of completed traces.\n# TYPE gotcha_traces_total counter\n",
+			"gotcha_traces_total{context=\"db \\\"query\\\"\"} 1\n",
+			"gotcha_traces_total{context=\"handler\"} 2\n",
+			"gotcha_bytes_total{context=\"handler\"} 2008\n",
+			"gotcha_objects_total{context=\"handler\"} 21\n",
+			"gotcha_calls_total{context=\"handler\"} 3\n",
+			"# TYPE gotcha_trace_bytes histogram\n",
+			"gotcha_trace_bytes_bucket{context=\"handler\",le=\"64\"} 1\n",
+			"gotcha_trace_bytes_bucket{context=\"handler\",le=\"1024\"} 1\n",
+			"gotcha_trace_bytes_bucket{context=\"handler\",le=\"4096\"} 2\n",
+			"gotcha_trace_bytes_bucket{context=\"handler\",le=\"+Inf\"} 2\n",
+			"gotcha_trace_bytes_sum{context=\"handler\"} 2008\n",
+			"gotcha_trace_bytes_count{context=\"handler\"} 2\n",
+			"gotcha_trace_objects_bucket{context=\"handler\",le=\"1048576\"} 2\n",
+			"gotcha_trace_calls_bucket{context=\"handler\",le=\"1\"} 1\n",
+			"gotcha_limit_exceeded_total{context=\"handler\",dimension=\"bytes\"} 0\n",
+			"gotcha_limit_exceeded_total{context=\"handler\",dimension=\"objects\"} 1\n",
+			"gotcha_limit_exceeded_total{context=\"handler\",dimension=\"calls\"} 0\n",
+			"gotcha_soft_limit_exceeded_total{context=\"handler\"} 1\n",
+		} {
+			require.Contains(t, out, line)
+		}
+	})
+	t.Run("collector observes traces completion", func(t *testing.T) {
+		c := NewCollector()
+		for i := 0; i < 3; i++ {
+			_ = gotcha.Trace(context.Background(), func(ctx gotcha.Context) {}, gotcha.ContextWithName("trace"), c.Option())
+		}
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+		require.Contains(t, rec.Body.String(), "gotcha_traces_total{context=\"trace\"} 3\n")
+	})
+}
@@ -0,0 +1,68 @@
+package gotcha
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rateBuckets defines number of buckets per rate sliding window.
+const rateBuckets = 10
+
+// rate defines lock free approximate sliding window rate counter
+// that splits window into fixed number of time buckets.
+type rate struct {
+	limit  int64
+	window time.Duration
+	epochs [rateBuckets]int64
+	counts [rateBuckets]int64
+}
+
+func newRate(limit int64, window time.Duration) *rate {
+	if window < rateBuckets {
+		window = rateBuckets
+	}
+	return &rate{limit: limit, window: window}
+}
+
+// epoch returns current bucket epoch for provided time.
+func (r *rate) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(r.window/rateBuckets)
+}
+
+// add adds provided value to the current time bucket
+// reusing outdated bucket if needed.
+func (r *rate) add(n int64, now time.Time) {
+	epoch := r.epoch(now)
+	i := epoch % rateBuckets
+	if e := atomic.LoadInt64(&r.epochs[i]); e != epoch && atomic.CompareAndSwapInt64(&r.epochs[i], e, epoch) {
+		atomic.StoreInt64(&r.counts[i], n)
+		return
+	}
+	atomic.AddInt64(&r.counts[i], n)
+}
+
+// sum returns total value for the sliding window ending at provided time.
+func (r *rate) sum(now time.Time) (sum int64) {
+	epoch := r.epoch(now)
+	for i := range r.counts {
+		if e := atomic.LoadInt64(&r.epochs[i]); e > epoch-rateBuckets && e <= epoch {
+			sum += atomic.LoadInt64(&r.counts[i])
+		}
+	}
+	return
+}
+
+// remains returns remaining sliding window budget for provided time.
+func (r *rate) remains(now time.Time) int64 {
+	if sum := r.sum(now); sum < r.limit {
+		return r.limit - sum
+	}
+	return 0
+}
+
+func (r *rate) reset() {
+	for i := range r.counts {
+		atomic.StoreInt64(&r.epochs[i], 0)
+		atomic.StoreInt64(&r.counts[i], 0)
+	}
+}
@@ -0,0 +1,153 @@
+package gotcha
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// maxCallSiteDepth defines max number of call site caller frames.
+const maxCallSiteDepth = 32
+
+// callSiteSkip defines number of extra frames captured in malloc tracing
+// to cover gotcha hook, mallocgc and runtime allocation helpers frames.
+const callSiteSkip = 8
+
+// mallocgcTrampolineName defines arch specific mallocgc entry trampoline function name.
+const mallocgcTrampolineName = "github.com/1pkg/gotcha.mallocgcTrampoline"
+
+// callstack defines raw captured caller pcs.
+type callstack [maxCallSiteDepth + callSiteSkip]uintptr
+
+// CallSite defines allocations that were traced from single call site.
+// Call site function, file and line point to the allocation location
+// while stack keeps raw program counters of call site callers.
+type CallSite struct {
+	Function              string
+	File                  string
+	Line                  int
+	Stack                 []uintptr
+	Bytes, Objects, Calls int64
+}
+
+// callsites defines call site allocations aggregator
+// that groups traced allocations by raw captured caller pcs.
+type callsites struct {
+	lock  glock
+	depth int
+	sites map[callstack]*CallSite
+}
+
+func newCallSites(depth int) *callsites {
+	if depth > maxCallSiteDepth {
+		depth = maxCallSiteDepth
+	}
+	return &callsites{
+		depth: depth,
+		sites: make(map[callstack]*CallSite),
+	}
+}
+
+// record captures caller pcs and attributes allocation to them.
+// Note that allocations made by record itself are not attributed.
+func (cs *callsites) record(id int64, bytes, objects, calls int64) {
+	if !cs.lock.lock(id) {
+		return
+	}
+	defer cs.lock.unlock()
+	var stack callstack
+	// skip runtime callers and record frames.
+	runtime.Callers(2, stack[:cs.depth+callSiteSkip])
+	site, ok := cs.sites[stack]
+	if !ok {
+		site = &CallSite{}
+		cs.sites[stack] = site
+	}
+	site.Bytes += bytes * objects
+	site.Objects += objects
+	site.Calls += calls
+}
+
+func (cs *callsites) reset() {
+	if !cs.lock.lock(goid()) {
+		return
+	}
+	defer cs.lock.unlock()
+	for stack := range cs.sites {
+		delete(cs.sites, stack)
+	}
+}
+
+// top resolves and merges recorded call sites
+// and returns top n of them sorted by bytes.
+func (cs *callsites) top(n int) []CallSite {
+	if !cs.lock.lock(goid()) {
+		return nil
+	}
+	stacks := make([]callstack, 0, len(cs.sites))
+	usages := make([]CallSite, 0, len(cs.sites))
+	for stack, site := range cs.sites {
+		stacks = append(stacks, stack)
+		usages = append(usages, *site)
+	}
+	cs.lock.unlock()
+	merged := make(map[callstack]int, len(stacks))
+	sites := make([]CallSite, 0, len(stacks))
+	for i, stack := range stacks {
+		pcs := cs.trim(stack)
+		var key callstack
+		copy(key[:], pcs)
+		if j, ok := merged[key]; ok {
+			sites[j].Bytes += usages[i].Bytes
+			sites[j].Objects += usages[i].Objects
+			sites[j].Calls += usages[i].Calls
+			continue
+		}
+		site := usages[i]
+		site.Stack = pcs
+		if len(pcs) > 0 {
+			frame, _ := runtime.CallersFrames(pcs).Next()
+			site.Function, site.File, site.Line = frame.Function, frame.File, frame.Line
+		}
+		merged[key] = len(sites)
+		sites = append(sites, site)
+	}
+	sort.SliceStable(sites, func(i, j int) bool {
+		return sites[i].Bytes > sites[j].Bytes
+	})
+	if n > 0 && n < len(sites) {
+		sites = sites[:n]
+	}
+	return sites
+}
+
+// trim drops gotcha hook, mallocgc and runtime allocation helpers frames
+// from provided raw caller pcs and limits them by call sites depth.
+// Note that mallocgc entry trampoline frame replaces mallocgc frame
+// for patches that trace allocations before mallocgc frame is set up.
+func (cs *callsites) trim(stack callstack) []uintptr {
+	pcs := stack[:]
+	for i, pc := range pcs {
+		if pc == 0 {
+			pcs = pcs[:i]
+			break
+		}
+	}
+	for i, pc := range pcs {
+		if f := runtime.FuncForPC(pc - 1); f != nil && (f.Name() == "runtime.mallocgc" || f.Name() == mallocgcTrampolineName) {
+			pcs = pcs[i+1:]
+			break
+		}
+	}
+	for len(pcs) > 0 {
+		f := runtime.FuncForPC(pcs[0] - 1)
+		if f == nil || !strings.HasPrefix(f.Name(), "runtime.") {
+			break
+		}
+		pcs = pcs[1:]
+	}
+	if len(pcs) > cs.depth {
+		pcs = pcs[:cs.depth]
+	}
+	return append([]uintptr(nil), pcs...)
+}
@@ -0,0 +1,80 @@
+package gotcha
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot defines consistent point in time gotcha context state
+// that could be diffed and combined with other snapshots.
+// Note that elapsed is zero for context snapshots and
+// it's set to time span between snapshots for snapshots diffs.
+type Snapshot struct {
+	Name     string        `json:"name,omitempty"`
+	Time     time.Time     `json:"time"`
+	Elapsed  time.Duration `json:"elapsed,omitempty"`
+	Bytes    int64         `json:"bytes"`
+	Objects  int64         `json:"objects"`
+	Calls    int64         `json:"calls"`
+	LBytes   int64         `json:"limit_bytes"`
+	LObjects int64         `json:"limit_objects"`
+	LCalls   int64         `json:"limit_calls"`
+}
+
+// Sub returns usage diff between snapshot and provided earlier snapshot
+// which is useful to measure phases within single trace.
+// Note that diff keeps snapshot name, time and limits.
+func (s Snapshot) Sub(o Snapshot) Snapshot {
+	s.Elapsed += s.Time.Sub(o.Time) - o.Elapsed
+	s.Bytes -= o.Bytes
+	s.Objects -= o.Objects
+	s.Calls -= o.Calls
+	return s
+}
+
+// Add returns usage sum of snapshot and provided snapshot.
+// Note that sum keeps snapshot name and limits
+// and uses the latest time of two snapshots.
+func (s Snapshot) Add(o Snapshot) Snapshot {
+	if o.Time.After(s.Time) {
+		s.Time = o.Time
+	}
+	s.Elapsed += o.Elapsed
+	s.Bytes += o.Bytes
+	s.Objects += o.Objects
+	s.Calls += o.Calls
+	return s
+}
+
+// seqlock defines lock free multi writers sequence lock
+// that lets readers detect concurrent writes and retry.
+type seqlock struct {
+	started, finished int64
+}
+
+func (l *seqlock) begin() {
+	atomic.AddInt64(&l.started, 1)
+}
+
+func (l *seqlock) end() {
+	atomic.AddInt64(&l.finished, 1)
+}
+
+// read calls provided read function until
+// it was called without any concurrent writes.
+// Note that read function should never allocate
+// as traced allocations would cause endless retries.
+func (l *seqlock) read(f func()) {
+	for {
+		finished := atomic.LoadInt64(&l.finished)
+		started := atomic.LoadInt64(&l.started)
+		if started == finished {
+			f()
+			if atomic.LoadInt64(&l.started) == started {
+				return
+			}
+		}
+		runtime.Gosched()
+	}
+}
@@ -1,11 +1,6 @@
 package gotcha
 
-import (
-	"context"
-	"unsafe"
-
-	"github.com/1pkg/golocal"
-)
+import "context"
 
 // Tracer defines function type that will be traced by gotcha
 // it accepts gotcha context that will be seamlessly tracking
@@ -15,10 +10,87 @@ type Tracer func(Context)
 // Trace starts memory tracing for provided tracer function.
 // Note that trace function could be cobined with each other
 // by providing gotcha context to child trace function.
-func Trace(ctx context.Context, t Tracer, opts ...ContextOpt) {
-	gctx := NewContext(ctx, opts...)
-	ptr := uintptr(unsafe.Pointer(gctx.(*gotchactx)))
-	golocal.LStore().Set(ptr)
-	defer golocal.LStore().Del()
+// Trace returns context aborted error only if tracer function
+// was aborted in hard stop mode by this trace context.
+// Note that if malloc tracing isn't installed, see `Install`,
+// tracer function is still executed but trace context doesn't track
+// any allocations and Trace returns error wrapping `ErrNotInstalled`,
+// similarly Trace returns `ErrDegraded` if malloc tracing is degraded.
+// Note that once trace completes its context is removed
+// from parent gotcha context children, see `Context.Children`,
+// and context trace completion hooks are called after goroutine is unbound.
+func Trace(ctx context.Context, t Tracer, opts ...ContextOpt) error {
+	gctx := NewContext(ctx, opts...).(*gotchactx)
+	if gctx.pctx != nil {
+		defer gctx.pctx.orphan(gctx)
+	}
+	var terr error
+	if len(gctx.ontraced) > 0 {
+		defer func() {
+			for _, f := range gctx.ontraced {
+				f(gctx, terr)
+			}
+		}()
+	}
+	if terr = trace(gctx, t); terr != nil {
+		return terr
+	}
+	return Status()
+}
+
+// Go starts provided tracer function in new goroutine
+// that inherits provided gotcha context tracing,
+// so all allocations made inside spawned goroutine
+// are rolled up into provided context and its limits.
+// Note that if provided context is not gotcha context implementation
+// then new derived unlimited gotcha context is created for spawned goroutine.
+// Note that context aborted error is discarded for spawned goroutine,
+// including aborts raised by any hard stop ancestor context
+// as spawned goroutine has no ancestor trace to unwind to.
+func Go(ctx Context, t Tracer) {
+	gctx, ok := ctx.(*gotchactx)
+	if !ok {
+		gctx = NewContext(ctx, ContextWithLimitBytes(Infinity)).(*gotchactx)
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if abort, ok := r.(*ContextAborted); ok && gctx.aborts(abort) {
+					return
+				}
+				panic(r)
+			}
+		}()
+		_ = trace(gctx, t)
+	}()
+}
+
+// binding defines goroutine local store binding of gotcha context
+// that additionally guards malloc tracing from reentering itself
+// through allocations made by malloc tracing for bound goroutine
+// and keeps previous goroutine binding restored once it's unbound.
+type binding struct {
+	gctx    *gotchactx
+	prev    *binding
+	tracing bool
+}
+
+// trace binds provided gotcha context to caller goroutine
+// local store for the whole tracer function execution
+// and recovers context hard stop abort panic if any.
+func trace(gctx *gotchactx, t Tracer) (err error) {
+	defer unbind(bind(gctx))
+	if gctx.abort != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				if abort, ok := r.(*ContextAborted); ok && abort == gctx.abort {
+					err = abort
+					return
+				}
+				panic(r)
+			}
+		}()
+	}
 	t(gctx)
+	return
 }
@@ -0,0 +1,100 @@
+package gotcha
+
+import (
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+// RawType defines type name for untyped allocations
+// such as noscan raw memory allocations.
+const RawType = "raw/noscan"
+
+// TypeAlloc defines allocations that were traced for single type.
+// Note that type is nil for untyped allocations.
+type TypeAlloc struct {
+	Name                  string
+	Type                  reflect.Type
+	Bytes, Objects, Calls int64
+}
+
+// eface from `runtime.eface`
+type eface struct {
+	tp   *tp
+	data unsafe.Pointer
+}
+
+// typeof resolves runtime type to reflect type.
+func typeof(tp *tp) reflect.Type {
+	var i interface{}
+	(*eface)(unsafe.Pointer(&i)).tp = tp
+	return reflect.TypeOf(i)
+}
+
+// typeallocs defines type allocations aggregator
+// that groups traced allocations by runtime type.
+type typeallocs struct {
+	lock  glock
+	types map[*tp]*TypeAlloc
+}
+
+func newTypeAllocs() *typeallocs {
+	return &typeallocs{types: make(map[*tp]*TypeAlloc)}
+}
+
+// record attributes allocation to provided runtime type.
+// Note that allocations made by record itself are not attributed.
+func (ta *typeallocs) record(id int64, tp *tp, bytes, objects, calls int64) {
+	if !ta.lock.lock(id) {
+		return
+	}
+	defer ta.lock.unlock()
+	talloc, ok := ta.types[tp]
+	if !ok {
+		talloc = &TypeAlloc{}
+		ta.types[tp] = talloc
+	}
+	talloc.Bytes += bytes * objects
+	talloc.Objects += objects
+	talloc.Calls += calls
+}
+
+func (ta *typeallocs) reset() {
+	if !ta.lock.lock(goid()) {
+		return
+	}
+	defer ta.lock.unlock()
+	for tp := range ta.types {
+		delete(ta.types, tp)
+	}
+}
+
+// top resolves recorded types and
+// returns top n of them sorted by bytes.
+func (ta *typeallocs) top(n int) []TypeAlloc {
+	if !ta.lock.lock(goid()) {
+		return nil
+	}
+	tps := make([]*tp, 0, len(ta.types))
+	types := make([]TypeAlloc, 0, len(ta.types))
+	for tp, talloc := range ta.types {
+		tps = append(tps, tp)
+		types = append(types, *talloc)
+	}
+	ta.lock.unlock()
+	for i, tp := range tps {
+		if tp == nil {
+			types[i].Name = RawType
+			continue
+		}
+		types[i].Type = typeof(tp)
+		types[i].Name = types[i].Type.String()
+	}
+	sort.SliceStable(types, func(i, j int) bool {
+		return types[i].Bytes > types[j].Bytes
+	})
+	if n > 0 && n < len(types) {
+		types = types[:n]
+	}
+	return types
+}